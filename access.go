@@ -1,17 +1,94 @@
 package aeio
 
 import (
+	"io/ioutil"
 	"net/http"
+	"sync"
 )
 
 type Access struct {
+	App     *App
 	Request *http.Request
 	Writer  http.ResponseWriter
+	// Principal is the verified identity of the caller, nil if anonymous. See Authenticate.
+	Principal *Principal
+
+	valuesMutex sync.RWMutex
+	values      map[string]interface{}
+
+	bodyOnce sync.Once
+	body     []byte
+	bodyErr  error
+
+	// tx is the transaction the actions of the request are running in, so the actions of other resources of the
+	// access, like the ones hooks create, join it.
+	txMutex sync.RWMutex
+	tx      Transaction
 }
 
-func newAccess(writer *http.ResponseWriter, request *http.Request) *Access {
+func newAccess(app *App, writer *http.ResponseWriter, request *http.Request) *Access {
 	return &Access{
+		App:     app,
 		Request: request,
 		Writer:  *writer,
 	}
 }
+
+// accessApp returns the App of the access, falling back to the default App.
+func accessApp(access *Access) *App {
+	if access != nil && access.App != nil {
+		return access.App
+	}
+	return Default()
+}
+
+// Set stashes a request scoped value, like the user, tenant or request id, for later middlewares, handlers and hooks.
+func (a *Access) Set(key string, value interface{}) {
+	a.valuesMutex.Lock()
+	defer a.valuesMutex.Unlock()
+	if a.values == nil {
+		a.values = make(map[string]interface{})
+	}
+	a.values[key] = value
+}
+
+// Value returns the request scoped value stashed with Set, or nil.
+func (a *Access) Value(key string) interface{} {
+	a.valuesMutex.RLock()
+	defer a.valuesMutex.RUnlock()
+	return a.values[key]
+}
+
+// Body returns the request body. It is read only once, so it can be bound again, like when a transaction is retried.
+func (a *Access) Body() ([]byte, error) {
+	a.bodyOnce.Do(func() {
+		a.body, a.bodyErr = ioutil.ReadAll(a.Request.Body)
+	})
+	return a.body, a.bodyErr
+}
+
+// transaction returns the transaction the request is running in, or nil.
+func (a *Access) transaction() Transaction {
+	if a == nil {
+		return nil
+	}
+	a.txMutex.RLock()
+	defer a.txMutex.RUnlock()
+	return a.tx
+}
+
+// enterTransaction makes the resources of the access join the transaction, until the returned function is called.
+func (a *Access) enterTransaction(tx Transaction) func() {
+	if a == nil {
+		return func() {}
+	}
+	a.txMutex.Lock()
+	previous := a.tx
+	a.tx = tx
+	a.txMutex.Unlock()
+	return func() {
+		a.txMutex.Lock()
+		a.tx = previous
+		a.txMutex.Unlock()
+	}
+}
@@ -1,66 +1,107 @@
 package aeio
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"google.golang.org/api/iterator"
 )
 
-// Create creates a new resource
+// Create creates a new resource. With an incomplete key the id is allocated by the store, with a complete one
+// the resource is created at that key, failing with a 409 if there is already an entity there, checked in a
+// transaction. See RegisterTransactional to run every create of a kind in one.
 func (r *Resource) Create() error {
 	var err error
 	r.EnterAction(ActionCreate)
 	defer r.ExitAction(ActionCreate)
 
-	if err = ValidateKey(r.Key); err != nil {
+	if err = r.App().Registry.ValidateKey(r.Key); err != nil {
 		return errorInvalidPath.withCause(err).withStack(10).withLog()
 	}
 
-	if !r.Key.Incomplete() {
-		return errorInvalidPath.withCause(errors.New("path key must be incomplete for creation")).withStack(10).withLog()
+	if r.Key.Incomplete() && r.App().Registry.KeyType(r.Key.Kind) == KeyTypeName {
+		return errorInvalidPath.withCause(errors.New("kind " + r.Key.Kind + " uses name keys, that can't be allocated")).withStack(10).withLog()
+	}
+
+	if err = r.authorizeAction(ActionCreate); err != nil {
+		return err
 	}
 
 	if r.Data == nil {
 		err = r.BindRequestData()
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
 		}
 	}
 
-	if data, ok := r.Data.(DataBeforeSave); ok {
-		err := data.BeforeSave(r)
-		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+	// a retry keeps the id allocated by the first attempt, but must not take it as a client supplied key
+	allocate := r.Key.Incomplete()
+	err = r.writeInTransaction(!allocate, func() error {
+		if data, ok := r.Data.(DataBeforeSave); ok {
+			err := data.BeforeSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
 		}
-	}
 
-	r.Key, err = DatastoreClient.Put(r.Access.Request.Context(), r.Key, r)
-	if err != nil {
-		return errorDatastorePut.withCause(err).withStack(10).withLog()
-	}
+		if err := r.checkActionRules(ActionCreate); err != nil {
+			return err
+		}
 
-	if data, ok := r.Data.(DataAfterSave); ok {
-		err := data.AfterSave(r)
+		if err := r.checkStrictParents(); err != nil {
+			return err
+		}
+
+		if !allocate {
+			err := r.storeGet(r.Key, &datastore.PropertyList{})
+			if err == nil {
+				return errorDatastoreConflict.withHint(fmt.Sprintf("%s already exists, use PUT to replace it", Path(r.Key))).withStack(10)
+			}
+			if !errors.Is(err, datastore.ErrNoSuchEntity) {
+				return err
+			}
+		}
+
+		r.Version = 0
+		r.touch()
+		r.Key, err = r.storePut(r.Key, r)
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
 		}
+
+		if data, ok := r.Data.(DataAfterSave); ok {
+			err := data.AfterSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(complexError); ok {
+		return err
 	}
+	if err != nil {
+		return errorDatastorePut.withCause(err).withStack(10).withLog()
+	}
+	r.setETag()
 
 	return nil
 }
 
+// Update patches the stored resource with the request data, or replaces it with the resource Data if already set.
+// The read and the write are done in a transaction, so concurrent updates don't overwrite each other, and the
+// If-Match and If-None-Match headers are checked against the stored ETag.
 func (r *Resource) Update() error {
 	var err error
 	r.EnterAction(ActionUpdate)
 	defer r.ExitAction(ActionUpdate)
 
-	err = ValidateKey(r.Key)
+	err = r.App().Registry.ValidateKey(r.Key)
 	if err != nil {
 		return errorInvalidPath.withCause(err).withStack(10).withLog()
 	}
@@ -69,35 +110,222 @@ func (r *Resource) Update() error {
 		return errorInvalidPath.withCause(errors.New("path key must be complete for update")).withStack(10).withLog()
 	}
 
-	if r.Data == nil {
-		err = r.Get()
+	if err = r.authorizeAction(ActionUpdate); err != nil {
+		return err
+	}
+
+	data := r.Data
+	err = r.writeInTransaction(true, func() error {
+		err := r.Get()
 		if err != nil {
 			return err
 		}
 
-		err = r.BindRequestData()
+		// the stored data must also satisfy the rules, so a caller can't take over someone else's entity, and they
+		// are checked before the preconditions so a denied caller doesn't learn the version
+		if data == nil {
+			if err = r.checkActionRules(ActionUpdate); err != nil {
+				return err
+			}
+		}
+
+		if err = r.checkPreconditions(true); err != nil {
+			return err
+		}
+
+		if data != nil {
+			r.Data = data
+		} else {
+			err = r.BindRequestData()
+			if err != nil {
+				return err
+			}
+		}
+
+		if data, ok := r.Data.(DataBeforeSave); ok {
+			err := data.BeforeSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
+
+		if err = r.checkActionRules(ActionUpdate); err != nil {
+			return err
+		}
+
+		r.touch()
+		r.Key, err = r.storePut(r.Key, r)
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
 		}
+
+		if data, ok := r.Data.(DataAfterSave); ok {
+			err := data.AfterSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(complexError); ok {
+		return err
+	}
+	if err != nil {
+		return errorDatastorePut.withCause(err).withStack(10).withLog()
+	}
+	r.setETag()
+
+	return nil
+}
+
+// Put creates or replaces the resource at its complete key. The request data is the whole new data, not a patch,
+// but the creation time of a replaced entity is kept. It is authorized and checked by rules as ActionCreate if there
+// is nothing stored at the key, or as ActionUpdate (on the stored and on the new data) if there is, and before that
+// it is authorized as ActionPut, so permissions may restrict the method too.
+// It checks If-Match and If-None-Match in a transaction, so "If-None-Match: *" only creates. Unconditional puts only
+// run in one if the kind is registered with RegisterTransactional.
+func (r *Resource) Put() error {
+	var err error
+	r.EnterAction(ActionPut)
+	defer r.ExitAction(ActionPut)
+
+	err = r.App().Registry.ValidateKey(r.Key)
+	if err != nil {
+		return errorInvalidPath.withCause(err).withStack(10).withLog()
+	}
+
+	if r.Key.Incomplete() {
+		return errorInvalidPath.withCause(errors.New("path key must be complete for put")).withStack(10).withLog()
+	}
+
+	if err = r.authorizeAction(ActionPut); err != nil {
+		return err
 	}
 
-	if data, ok := r.Data.(DataBeforeSave); ok {
-		err := data.BeforeSave(r)
+	data := r.Data
+	err = r.writeInTransaction(r.conditional(), func() error {
+		action := ActionUpdate
+		err := r.Get()
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			action = ActionCreate
+			r.CreatedAt = time.Time{}
+			r.Version = 0
+		} else if err != nil {
+			return err
+		}
+
+		if err = r.authorizeAction(action); err != nil {
+			return err
+		}
+
+		if action == ActionUpdate {
+			if err = r.checkActionRules(ActionUpdate); err != nil {
+				return err
+			}
+		} else if err = r.checkStrictParents(); err != nil {
+			return err
+		}
+
+		if err = r.checkPreconditions(action == ActionUpdate); err != nil {
+			return err
+		}
+
+		stored := r.Data
+		r.Data = data
+		if r.Data == nil {
+			err = r.BindRequestData()
+			if err != nil {
+				return err
+			}
+			if action == ActionUpdate {
+				err = r.keepUnwritable(stored)
+				if err != nil {
+					return errorRequestUnmarshal.withCause(err).withStack(10)
+				}
+			}
+		}
+
+		if data, ok := r.Data.(DataBeforeSave); ok {
+			err := data.BeforeSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
+
+		if err = r.checkActionRules(action); err != nil {
+			return err
+		}
+
+		r.touch()
+		r.Key, err = r.storePut(r.Key, r)
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
+		}
+
+		if data, ok := r.Data.(DataAfterSave); ok {
+			err := data.AfterSave(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
 		}
+		return nil
+	})
+	if _, ok := err.(complexError); ok {
+		return err
+	}
+	if err != nil {
+		return errorDatastorePut.withCause(err).withStack(10).withLog()
+	}
+	r.setETag()
+
+	return nil
+}
+
+// Allocate reserves n ids of the resource kind under its parent, listing them as keys in Resources, so clients can
+// create entities offline and Put them later. It is authorized as ActionAllocate and as ActionCreate. n is limited like
+// the query size.
+func (r *Resource) Allocate(n int) error {
+	var err error
+	r.EnterAction(ActionAllocate)
+	defer r.ExitAction(ActionAllocate)
+
+	if !r.Key.Incomplete() {
+		return errorInvalidPath.withHint("Ids are allocated for models, not ids: remove the id from the end of path").withStack(10).withLog()
 	}
 
-	r.Key, err = DatastoreClient.Put(r.Access.Request.Context(), r.Key, r)
+	err = r.App().Registry.ValidateKey(r.Key)
+	if err != nil {
+		return errorInvalidPath.withCause(err).withStack(10).withLog()
+	}
+
+	if r.App().Registry.KeyType(r.Key.Kind) == KeyTypeName {
+		return errorInvalidPath.withCause(errors.New("kind " + r.Key.Kind + " uses name keys, that can't be allocated")).withStack(10).withLog()
+	}
+
+	if err = r.authorizeAction(ActionAllocate); err != nil {
+		return err
+	}
+	if err = r.authorizeAction(ActionCreate); err != nil {
+		return err
+	}
+
+	if n <= 0 {
+		n = 1
+	} else if n > r.App().Config.QuerySizeMax {
+		n = r.App().Config.QuerySizeMax
+	}
+
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.IncompleteKey(r.Key.Kind, r.Key.Parent)
+	}
+	keys, err = r.App().Store.AllocateIDs(r.Context(), keys)
 	if err != nil {
 		return errorDatastorePut.withCause(err).withStack(10).withLog()
 	}
 
-	if data, ok := r.Data.(DataAfterSave); ok {
-		err := data.AfterSave(r)
-		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
-		}
+	for _, k := range keys {
+		r.Resources = append(r.Resources, &Resource{Key: k, Access: r.Access})
 	}
 
 	return nil
@@ -114,12 +342,22 @@ func (r *Resource) Get() error {
 		return errorInvalidPath.withHint(fmt.Sprintf("%s", "The key passed to read is incomplete")).withStack(10).withLog()
 	}
 
-	err = ValidateKey(r.Key)
+	err = r.App().Registry.ValidateKey(r.Key)
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
 
-	r.Data, err = NewObject(r.Key.Kind)
+	if err = r.authorizeAction(ActionRead); err != nil {
+		return err
+	}
+
+	fields, err := r.requestFields()
+	if err != nil {
+		return err
+	}
+	r.useFields(fields)
+
+	r.Data, err = r.App().Registry.NewObject(r.Key.Kind)
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
@@ -131,11 +369,21 @@ func (r *Resource) Get() error {
 		}
 	}
 
-	err = DatastoreClient.Get(r.Access.Request.Context(), r.Key, r)
+	err = r.storeGet(r.Key, r)
 	if err != nil {
 		return errorDatastoreRead.withCause(err).withStack(10).withLog()
 	}
 
+	if err = r.checkActionRules(ActionRead); err != nil {
+		return err
+	}
+
+	// 304 responses carry the ETag too
+	r.setETag()
+	if err = r.checkPreconditions(true); err != nil {
+		return err
+	}
+
 	if data, ok := r.Data.(DataAfterLoad); ok {
 		err = data.AfterLoad(r)
 		if err != nil {
@@ -146,6 +394,10 @@ func (r *Resource) Get() error {
 	return nil
 }
 
+// GetMany lists the entities of the kind under the parent of the key. Lists are eventually consistent, as they query
+// the Parent property, unless the kind is registered with RegisterStrongLists or the X-Consistency header is "strong"
+// ("eventual" turns it off). Strong lists are ancestor queries, consistent with the writes before them, but slower,
+// and sorting or filtering them needs composite indexes with the ancestor. Lists of root kinds are always eventual.
 func (r *Resource) GetMany() error {
 	var err error
 	r.EnterAction(ActionReadMany)
@@ -156,17 +408,21 @@ func (r *Resource) GetMany() error {
 		return errorInvalidPath.withHint("Lists only works under models, not ids: remove the id from the end of path").withStack(10).withLog()
 	}
 
-	err = ValidateKey(r.Key)
+	err = r.App().Registry.ValidateKey(r.Key)
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
 
-	q := datastore.NewQuery(r.Key.Kind)
-	if r.Key.Parent != nil {
-		q = q.Filter("Parent =", r.Key.Parent)
+	if err = r.authorizeAction(ActionReadMany); err != nil {
+		return err
 	}
 
+	q := r.listQuery()
+
 	err = r.RunListQuery(q)
+	if _, ok := err.(complexError); ok {
+		return err
+	}
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
@@ -174,6 +430,28 @@ func (r *Resource) GetMany() error {
 	return nil
 }
 
+// listQuery is the query of GetMany and GetManyCount. Strong lists keep the Parent filter, so only direct children
+// are listed and not the ones of the same kind deeper in the ancestor.
+func (r *Resource) listQuery() *Query {
+	q := NewQuery(r.Key.Kind)
+	if r.Key.Parent == nil {
+		return q
+	}
+	q = q.Filter("Parent =", r.Key.Parent)
+
+	strong := r.App().Registry.StrongLists(r.Key.Kind)
+	switch strings.ToLower(r.Access.Request.Header.Get(headerConsistency)) {
+	case consistencyStrong:
+		strong = true
+	case consistencyEventual:
+		strong = false
+	}
+	if strong {
+		q = q.Ancestor(r.Key.Parent)
+	}
+	return q
+}
+
 func (r *Resource) GetManyCount() error {
 	var err error
 	r.EnterAction(ActionReadManyCount)
@@ -184,17 +462,18 @@ func (r *Resource) GetManyCount() error {
 		return errorInvalidPath.withHint("Lists only works under models, not ids: remove the id from the end of path").withStack(10).withLog()
 	}
 
-	err = ValidateKey(r.Key)
+	err = r.App().Registry.ValidateKey(r.Key)
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
 
-	q := datastore.NewQuery(r.Key.Kind)
-	if r.Key.Parent != nil {
-		q = q.Filter("Parent =", r.Key.Parent)
+	if err = r.authorizeAction(ActionReadManyCount); err != nil {
+		return err
 	}
 
-	count, err := DatastoreClient.Count(r.Access.Request.Context(), q)
+	q := r.listQuery()
+
+	count, err := r.App().Store.Count(r.Context(), q)
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
@@ -214,19 +493,26 @@ func (r *Resource) GetAny() error {
 		return errorInvalidPath
 	}
 
-	// err = ValidateKey(r.Key)
+	// err = r.App().Registry.ValidateKey(r.Key)
 	// if err != nil {
 	// 	return err
 	// }
 
 	log.Println(r.Key.String(), r.Key.Kind)
 
-	q := datastore.NewQuery(r.Key.Kind)
+	if err = r.authorizeAction(ActionReadAny); err != nil {
+		return err
+	}
+
+	q := NewQuery(r.Key.Kind)
 	if r.Key.Parent != nil {
 		q = q.Ancestor(r.Key.Parent)
 	}
 
 	err = r.RunListQuery(q)
+	if _, ok := err.(complexError); ok {
+		return err
+	}
 	if err != nil {
 		return errorUnknown.withCause(err).withStack(10).withLog()
 	}
@@ -242,131 +528,184 @@ const (
 	headerFilters = "X-Filters"
 	headerSorters = "X-Sorters"
 	headerCounter = "X-Counter"
+
+	// paramKeysOnly makes lists respond only the keys, like GET /company/1/invoice?keysOnly or ?keysOnly=true
+	paramKeysOnly = "keysOnly"
+
+	headerConsistency   = "X-Consistency"
+	consistencyStrong   = "strong"
+	consistencyEventual = "eventual"
 )
 
-func (r *Resource) RunListQuery(q *datastore.Query) error {
+func (r *Resource) RunListQuery(q *Query) error {
 	var err error
 
-	// query sorters fields separated by comma
-	sorters := r.Access.Request.Header.Get(headerSorters)
-	if sorters != "" {
-		sortersSlice := strings.Split(sorters, ",")
-		for _, v := range sortersSlice {
-			q = q.Order(v)
-		}
+	q, err = r.applyListParams(q)
+	if err != nil {
+		return err
 	}
 
-	// one of ">", "<", ">=", "<=", or "="
-	// filters = {"fieldString=":"word", "fieldInt>": 1}
-	// decode header
-
-	fs := r.Access.Request.Header.Get(headerFilters)
-
-	type Filter struct {
-		Field string
-		Value interface{}
-	}
-	var filters []Filter
-	if fs != "" {
-		err = json.Unmarshal([]byte(fs), &filters)
-		if err != nil {
-			log.Println(err)
-		} else {
-			for _, v := range filters {
-				q = q.Filter(v.Field, v.Value)
+	// keysOnly without a value is true
+	keysOnly := false
+	if values, ok := r.Access.Request.URL.Query()[paramKeysOnly]; ok {
+		keysOnly = true
+		if values[0] != "" {
+			keysOnly, err = strconv.ParseBool(values[0])
+			if err != nil {
+				return errorInvalidListQuery.withHint("keysOnly is true or false").withCause(err).withStack(10)
 			}
 		}
 	}
 
 	// cursor
-	var cursor datastore.Cursor
 	next := r.Access.Request.Header.Get(headerNext)
 	if next != "" {
-		cursor, err = datastore.DecodeCursor(next)
-		if err != nil {
-			return errorDatastoreInvalidCursor.withCause(err).withStack(10)
-		}
-		q = q.Start(cursor)
+		q = q.Start(next)
 	} else if r.Access.Request.Header.Get(headerCounter) != "" {
 		// there is no next
 		// there is counter
-		n, err := DatastoreClient.Count(r.Access.Request.Context(), q)
+		n, err := r.App().Store.Count(r.Context(), q)
+		if isMissingIndex(err) {
+			return missingIndexError(q, err)
+		}
+		if errors.Is(err, ErrScanLimit) {
+			return scanLimitError(err)
+		}
 		if err != nil {
 			return err
 		}
 		r.ResourcesCount = &n
 	}
 
+	// Keys only lists respond just the keys, without loading entities or running hooks. Kinds with read rules still
+	// load them to check the rules, so hidden rows are not revealed.
+	keysRules := keysOnly && len(r.App().Registry.rules[r.Key.Kind][ActionRead]) > 0
+	if keysOnly {
+		r.fields = []string{}
+		if !keysRules {
+			q = q.KeysOnly()
+		}
+	} else {
+		// the count and cursor don't depend on the projection, only the rows
+		fields, err := r.requestFields()
+		if err != nil {
+			return err
+		}
+		r.useFields(fields)
+		if projection := r.projection(q, fields); projection != nil {
+			q = q.Project(projection...)
+		}
+	}
+
 	// query size
 	size, err := strconv.Atoi(r.Access.Request.Header.Get(headerSize))
 	if err != nil || size == 0 {
-		size = QuerySizeDefault
-	} else if size > QuerySizeMax {
-		size = QuerySizeMax
+		size = r.App().Config.QuerySizeDefault
+	} else if size > r.App().Config.QuerySizeMax {
+		size = r.App().Config.QuerySizeMax
 	}
 	q = q.Limit(size)
 
 	// finally, run one page!
-	ite := DatastoreClient.Run(r.Access.Request.Context(), q)
+	ite := r.App().Store.Run(r.Context(), q)
+
+	// Each entity is read once into props, so BeforeLoad runs with the key known and before the data is loaded,
+	// like in Get. The resources of the page come from one allocation. Run one by one, props is reused between rows,
+	// otherwise all rows are read before their hooks run in the workers. The iterator is never shared.
+	hooks := r.App().Registry.LoadHooks(r.Key.Kind)
+	concurrent := hooks.Workers > 1 && !keysOnly
+	var props datastore.PropertyList
+	var rows []datastore.PropertyList
+	page := make([]Resource, size)
+	r.Resources = make([]*Resource, 0, size)
+	done := false
 
 	for i := 0; i < size; i++ {
-
-		// this is the use case of a NewClone() method for r
-		nr := new(Resource)
-		nr.Access = r.Access
-		nr.ActionsStack = r.ActionsStack
-
-		nr.Data, err = NewObject(r.Key.Kind)
-		if err != nil {
-			return err
+		nr := &page[len(r.Resources)]
+		if concurrent {
+			nr = &page[len(rows)]
+			props = nil
 		}
+		// hooks get their own stack, so nested actions don't append to a shared array
+		*nr = Resource{Access: r.Access, ActionsStack: r.ActionsStack[:len(r.ActionsStack):len(r.ActionsStack)], fields: r.fields}
 
-		nrTemp := new(Resource)
-		nrTemp.Access = r.Access
-		nrTemp.Data, err = NewObject(r.Key.Kind)
-		if err != nil {
-			return err
+		if !keysOnly || keysRules {
+			nr.Data, err = r.App().Registry.NewObject(r.Key.Kind)
+			if err != nil {
+				return err
+			}
 		}
 
+		props = props[:0]
 		var iteErr error
-		nr.Key, iteErr = ite.Next(nrTemp)
+		nr.Key, iteErr = ite.Next(&props)
 		if iteErr == iterator.Done {
-			r.Next = ""
+			done = true
 			break
+		} else if errors.Is(iteErr, ErrInvalidCursor) {
+			return errorDatastoreInvalidCursor.withCause(iteErr).withStack(10)
+		} else if errors.Is(iteErr, ErrScanLimit) {
+			return scanLimitError(iteErr)
+		} else if isMissingIndex(iteErr) && len(q.Projection) > 0 && i == 0 {
+			// projections of many properties need composite indexes, without them the whole entities are loaded
+			q = q.Project()
+			ite = r.App().Store.Run(r.Context(), q)
+			i--
+			continue
+		} else if isMissingIndex(iteErr) {
+			return missingIndexError(q, iteErr)
 		} else if iteErr != nil {
 			return errorUnknown.withCause(iteErr).withStack(10).withLog()
 		}
 
-		// TODO: Just for using BeforeLoad we need to copy data two times because of the temp. Check if next and get are equivalent and use only one get.
-		if data, ok := nr.Data.(DataBeforeLoad); ok {
-			err = data.BeforeLoad(nr)
-			if err != nil {
-				if err := nrTemp.CopyData(nr); err != nil {
-					log.Print(err)
+		if keysOnly {
+			if keysRules {
+				if err := nr.Load(props); err != nil {
+					return errorUnknown.withCause(err).withStack(10)
+				}
+				if err := nr.CheckRules(ActionRead); err != nil {
+					continue
 				}
-				r.Resources = append(r.Resources, nr)
-				return errorUnknown.withCause(err).withStack(10)
+				nr.Data = nil
 			}
+			r.Resources = append(r.Resources, nr)
+			continue
 		}
 
-		if err := nrTemp.CopyData(nr); err != nil {
-			return errorUnknown.withCause(err).withStack(10)
+		if concurrent {
+			rows = append(rows, props)
+			continue
 		}
 
-		if data, ok := nr.Data.(DataAfterLoad); ok {
-			err = data.AfterLoad(nr)
-			if err != nil {
-				r.Resources = append(r.Resources, nr)
-				return errorUnknown.withCause(err).withStack(10)
+		visible, err := nr.loadListRow(props)
+		if err != nil {
+			if hooks.SkipFailed {
+				log.Println("skipping", Path(nr.Key), err)
+				continue
 			}
+			r.Resources = append(r.Resources, nr)
+			return err
+		}
+		// rows the caller can't read are left out of the page, but still move the cursor
+		if visible {
+			r.Resources = append(r.Resources, nr)
 		}
+	}
 
-		r.Resources = append(r.Resources, nr)
+	if concurrent {
+		err = r.loadListRows(page[:len(rows)], rows, hooks)
+		if err != nil {
+			return err
+		}
+	}
 
-		cursor, err = ite.Cursor()
+	// the cursor is only needed after the last row read
+	r.Next = ""
+	if !done {
+		cursor, err := ite.Cursor()
 		if err == nil {
-			r.Next = cursor.String()
-			r.Access.Request.Header.Set("X-Cursor", cursor.String())
+			r.Next = cursor
+			r.Access.Request.Header.Set("X-Cursor", cursor)
 		}
 	}
 
@@ -376,33 +715,56 @@ func (r *Resource) RunListQuery(q *datastore.Query) error {
 	return nil
 }
 
+// Delete removes the stored resource, checking If-Match in a transaction. Unconditional deletes only run in one if
+// the kind is registered with RegisterTransactional.
 func (r *Resource) Delete() error {
 	var err error
 	r.EnterAction(ActionDelete)
 	defer r.ExitAction(ActionDelete)
 
-	err = r.Get()
-	if err != nil {
+	if err = r.authorizeAction(ActionDelete); err != nil {
 		return err
 	}
 
-	if data, ok := r.Data.(DataBeforeDelete); ok {
-		err = data.BeforeDelete(r)
+	err = r.writeInTransaction(r.conditional(), func() error {
+		err := r.Get()
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
 		}
-	}
 
-	err = DatastoreClient.Delete(r.Access.Request.Context(), r.Key)
-	if err != nil {
-		return errorDatastoreDelete.withCause(err).withStack(10).withLog()
-	}
+		if err = r.checkActionRules(ActionDelete); err != nil {
+			return err
+		}
+
+		if err = r.checkPreconditions(true); err != nil {
+			return err
+		}
+
+		if data, ok := r.Data.(DataBeforeDelete); ok {
+			err = data.BeforeDelete(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
 
-	if data, ok := r.Data.(DataAfterDelete); ok {
-		err = data.AfterDelete(r)
+		err = r.storeDelete(r.Key)
 		if err != nil {
-			return errorUnknown.withCause(err).withStack(10).withLog()
+			return err
 		}
+
+		if data, ok := r.Data.(DataAfterDelete); ok {
+			err = data.AfterDelete(r)
+			if err != nil {
+				return errorUnknown.withCause(err).withStack(10).withLog()
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(complexError); ok {
+		return err
+	}
+	if err != nil {
+		return errorDatastoreDelete.withCause(err).withStack(10).withLog()
 	}
 
 	return nil
@@ -0,0 +1,138 @@
+package aeio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+// transactionCountStore counts the transactions run on the MemoryStore.
+type transactionCountStore struct {
+	*MemoryStore
+	transactions int
+}
+
+func (s *transactionCountStore) Transaction(ctx context.Context, f func(tx Transaction) error) error {
+	s.transactions++
+	return s.MemoryStore.Transaction(ctx, f)
+}
+
+func TestUpdateInTransaction(t *testing.T) {
+	store := &transactionCountStore{MemoryStore: NewMemoryStore()}
+	reg := NewRegistry()
+	reg.RegisterModel("txcompany", routerTestCompany{})
+	reg.RegisterChild("", "txcompany")
+	app, err := New(Config{Store: store, Registry: reg, DisableFirebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	rt := app.NewRouter("")
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/txcompany", `{"name":"acme"}`, nil)
+	if w.Code != http.StatusOK || store.transactions != 0 {
+		t.Fatalf("create: %d %v in %d transactions", w.Code, res, store.transactions)
+	}
+	company, _ := res["key"].(string)
+
+	w, res = routerTestServe(t, rt, http.MethodPatch, company, `{"name":"acme inc"}`, nil)
+	if w.Code != http.StatusOK || store.transactions != 1 {
+		t.Fatalf("unconditional update: %d %v in %d transactions, want 1", w.Code, res, store.transactions)
+	}
+}
+
+func TestListKeysOnlyParam(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("")
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/rtcompany", `{"name":"acme"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %v", w.Code, res)
+	}
+
+	tests := []struct {
+		query    string
+		code     int
+		keysOnly bool
+	}{
+		{"", http.StatusOK, false},
+		{"?keysOnly", http.StatusOK, true},
+		{"?keysOnly=", http.StatusOK, true},
+		{"?keysOnly=true", http.StatusOK, true},
+		{"?keysOnly=1", http.StatusOK, true},
+		{"?keysOnly=false", http.StatusOK, false},
+		{"?keysOnly=0", http.StatusOK, false},
+		{"?keysOnly=maybe", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w, res := routerTestServe(t, rt, http.MethodGet, "/rtcompany"+tt.query, "", nil)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, res)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			resources := bulkTestResources(t, res)
+			if len(resources) != 1 || resources[0]["key"] == nil {
+				t.Fatalf("got resources %v", resources)
+			}
+			if _, ok := resources[0]["data"]; ok == tt.keysOnly {
+				t.Fatalf("keys only %v, got %v", tt.keysOnly, resources[0])
+			}
+		})
+	}
+}
+
+type benchListItem struct {
+	Number int64  `json:"number"`
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// BenchmarkRunListQuery lists a page of 1000 entities from a MemoryStore, to follow the allocations per row.
+func BenchmarkRunListQuery(b *testing.B) {
+	reg := NewRegistry()
+	reg.RegisterModel("benchcompany", benchListItem{})
+	reg.RegisterModel("benchinvoice", benchListItem{})
+	reg.RegisterChild("", "benchcompany")
+	reg.RegisterChild("benchcompany", "benchinvoice")
+
+	app, err := New(Config{Store: NewMemoryStore(), Registry: reg, DisableFirebase: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer app.Close()
+
+	parent := datastore.IDKey("benchcompany", 1, nil)
+	for i := 0; i < 1000; i++ {
+		k := datastore.IncompleteKey("benchinvoice", parent)
+		_, err = app.Store.Put(context.Background(), k, &Resource{Key: k, Data: &benchListItem{Number: int64(i), Status: "open", Note: "note"}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/benchcompany/1/benchinvoice", nil)
+		request.Header.Set(headerSize, "1000")
+		writer := http.ResponseWriter(httptest.NewRecorder())
+		r, err := app.NewResourceFromRequest(&writer, request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = r.RunListQuery(r.listQuery())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(r.Resources) != 1000 {
+			b.Fatalf("listed %d entities, want 1000", len(r.Resources))
+		}
+	}
+}
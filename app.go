@@ -0,0 +1,200 @@
+package aeio
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	firebase "firebase.google.com/go/v4"
+	firebaseAuth "firebase.google.com/go/v4/auth"
+	"google.golang.org/api/option"
+)
+
+// Config holds the settings used by New to build an App. Zero values fall back to the package defaults.
+type Config struct {
+	// Context is the parent of the App context. Defaults to context.Background().
+	Context context.Context
+
+	// ProjectID is the Google Cloud project. Defaults to datastore.DetectProjectID.
+	ProjectID string
+	// ClientOptions are passed to the datastore and firebase clients, e.g. option.WithCredentialsFile.
+	ClientOptions []option.ClientOption
+
+	// Store replaces the datastore client as storage backend. If set, no datastore client is created
+	// unless DatastoreClient is also set.
+	Store Store
+	// DatastoreClient is an already connected client to be used instead of creating a new one.
+	DatastoreClient *datastore.Client
+
+	// Firebase is the firebase app configuration. Nil lets firebase detect it from the environment.
+	Firebase *firebase.Config
+	// DisableFirebase skips the firebase app and auth client creation.
+	DisableFirebase bool
+
+	// Registry holds models and paternity rules. Defaults to the DefaultRegistry.
+	Registry *Registry
+
+	// Authenticator, if set, is run by the routers of the app before anything else, attaching the caller
+	// Principal to the Access. See NewFirebaseAuthenticator and NewJWKSFileAuthenticator.
+	Authenticator Authenticator
+
+	Development      bool
+	QuerySizeDefault int
+	QuerySizeMax     int
+	ServerHost       string
+	ServerPort       string
+
+	// BatchSizeMax limits the operations of a batch request. Defaults to DefaultBatchSizeMax.
+	BatchSizeMax int
+
+	// BulkSizeMax limits the items of bulk create, update and delete requests. Defaults to DefaultBulkSizeMax.
+	BulkSizeMax int
+
+	// TransactionAttempts limits the runs of a transaction failing by contention. Defaults to DefaultTransactionAttempts.
+	TransactionAttempts int
+
+	// Server timeouts. Zero uses the defaults, negative values disable them.
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile make Serve use HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// UnixSocket makes Serve listen on the unix domain socket path instead of host and port.
+	UnixSocket string
+}
+
+// Default server timeouts, used when the Config doesn't set them.
+const (
+	DefaultReadTimeout     = 30 * time.Second
+	DefaultWriteTimeout    = 60 * time.Second
+	DefaultIdleTimeout     = 120 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// App is an explicit aeio instance, holding the clients, registry, query limits and server settings that
+// resources use. Build it with New. Package level functions use the default instance, see Default.
+type App struct {
+	Config Config
+
+	Context           context.Context
+	ContextCancel     context.CancelFunc
+	DatastoreClient   *datastore.Client
+	FireApp           *firebase.App
+	FireAppAuthClient *firebaseAuth.Client
+	Store             Store
+	Registry          *Registry
+	Authenticator     Authenticator
+
+	ownsDatastoreClient bool
+	closeOnce           sync.Once
+}
+
+// New builds an App from the config, connecting to the needed services.
+// Unlike the package initialization of older versions, errors are returned and never fatal.
+func New(config Config) (*App, error) {
+	var err error
+	app := &App{Config: config}
+
+	if app.Config.Context == nil {
+		app.Config.Context = context.Background()
+	}
+	if app.Config.ProjectID == "" {
+		app.Config.ProjectID = datastore.DetectProjectID
+	}
+	if app.Config.Registry == nil {
+		app.Config.Registry = DefaultRegistry
+	}
+	if app.Config.QuerySizeDefault == 0 {
+		app.Config.QuerySizeDefault = QuerySizeDefault
+	}
+	if app.Config.QuerySizeMax == 0 {
+		app.Config.QuerySizeMax = QuerySizeMax
+	}
+	if app.Config.ServerPort == "" {
+		app.Config.ServerPort = ServerPort
+	}
+	if app.Config.ServerHost == "" {
+		app.Config.ServerHost = ServerHost
+	}
+	if app.Config.BatchSizeMax <= 0 {
+		app.Config.BatchSizeMax = DefaultBatchSizeMax
+	}
+	if app.Config.BulkSizeMax <= 0 {
+		app.Config.BulkSizeMax = DefaultBulkSizeMax
+	}
+	if app.Config.TransactionAttempts <= 0 {
+		app.Config.TransactionAttempts = DefaultTransactionAttempts
+	}
+	app.Config.ReadTimeout = timeoutOrDefault(app.Config.ReadTimeout, DefaultReadTimeout)
+	app.Config.WriteTimeout = timeoutOrDefault(app.Config.WriteTimeout, DefaultWriteTimeout)
+	app.Config.IdleTimeout = timeoutOrDefault(app.Config.IdleTimeout, DefaultIdleTimeout)
+	app.Config.ShutdownTimeout = timeoutOrDefault(app.Config.ShutdownTimeout, DefaultShutdownTimeout)
+
+	app.Context, app.ContextCancel = context.WithCancel(app.Config.Context)
+	app.Registry = app.Config.Registry
+	app.DatastoreClient = app.Config.DatastoreClient
+	app.Store = app.Config.Store
+	app.Authenticator = app.Config.Authenticator
+	if a, ok := app.Authenticator.(interface{ useRegistry(*Registry) }); ok {
+		a.useRegistry(app.Registry)
+	}
+
+	if app.Store == nil && app.DatastoreClient == nil {
+		app.DatastoreClient, err = datastore.NewClient(app.Context, app.Config.ProjectID, app.Config.ClientOptions...)
+		if err != nil {
+			app.ContextCancel()
+			return nil, errorAppInit.withCause(err).withHint("error initializing datastore client")
+		}
+		app.ownsDatastoreClient = true
+	}
+	if app.Store == nil {
+		app.Store = NewDatastoreStore(app.DatastoreClient)
+	}
+
+	if !app.Config.DisableFirebase {
+		app.FireApp, err = firebase.NewApp(app.Context, app.Config.Firebase, app.Config.ClientOptions...)
+		if err != nil {
+			app.Close()
+			return nil, errorAppInit.withCause(err).withHint("error initializing firebase app")
+		}
+
+		app.FireAppAuthClient, err = app.FireApp.Auth(app.Context)
+		if err != nil {
+			app.Close()
+			return nil, errorAppInit.withCause(err).withHint("error initializing firebase auth client")
+		}
+	}
+
+	return app, nil
+}
+
+// Close cancels the App context and then releases the clients created by the App.
+// It is safe to call it more than once.
+func (app *App) Close() {
+	app.closeOnce.Do(func() {
+		app.ContextCancel()
+
+		if app.ownsDatastoreClient && app.DatastoreClient != nil {
+			err := app.DatastoreClient.Close()
+			if err != nil {
+				log.Print("error_closing_datastore_client:", err)
+			}
+		}
+	})
+}
+
+// timeoutOrDefault returns the default for zero timeouts, and zero (no timeout) for negative ones.
+func timeoutOrDefault(timeout time.Duration, def time.Duration) time.Duration {
+	switch {
+	case timeout == 0:
+		return def
+	case timeout < 0:
+		return 0
+	}
+	return timeout
+}
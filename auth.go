@@ -0,0 +1,175 @@
+package aeio
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	firebaseAuth "firebase.google.com/go/v4/auth"
+)
+
+// Principal is the verified identity of the caller, attached to the Access of the request.
+type Principal struct {
+	Subject string
+	Roles   []string
+	Claims  map[string]interface{}
+	// Key is the key of the entity representing the caller (ie. /user/123), when the token links one.
+	Key *datastore.Key
+}
+
+// HasRole checks if the principal has the role.
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator verifies the credentials of a request. It returns a nil Principal and nil error if the request
+// carries no credentials at all (anonymous), and an error if the credentials are invalid.
+type Authenticator interface {
+	Authenticate(request *http.Request) (*Principal, error)
+}
+
+// Authenticate returns a middleware that authenticates the request and attaches the Principal to the Access.
+// Routers of apps with a configured Authenticator already run it before all other middlewares.
+func Authenticate(authenticator Authenticator) Middleware {
+	return func(next Handler) Handler {
+		return func(r *Resource) error {
+			p, err := authenticator.Authenticate(r.Access.Request)
+			if err != nil {
+				return errorUnauthorized.withCause(err).withStack(10)
+			}
+			r.Access.Principal = p
+			return next(r)
+		}
+	}
+}
+
+// Principal returns the verified identity of the caller, or nil for anonymous requests.
+func (r *Resource) Principal() *Principal {
+	if r.Access == nil {
+		return nil
+	}
+	return r.Access.Principal
+}
+
+// BearerToken extracts the token of the Authorization header. The "Bearer" scheme is optional for
+// compatibility with clients sending the raw token.
+func BearerToken(request *http.Request) string {
+	header := strings.TrimSpace(request.Header.Get("Authorization"))
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return header
+}
+
+// ClaimsMapping tells how to build a Principal from token claims.
+type ClaimsMapping struct {
+	// RoleClaim holds the role as a string or the roles as a list of strings. Defaults to "role".
+	RoleClaim string
+	// UserKeyClaim holds the caller entity as a path ("/user/123") or as an id or name of UserKind. Defaults to "userId".
+	UserKeyClaim string
+	// UserKind is the kind used for UserKeyClaim ids. Defaults to "user".
+	UserKind string
+	// UserNames makes UserKeyClaim values names of UserKind even if they are numeric, like some Firebase UIDs.
+	UserNames bool
+	// Registry validates the paths of UserKeyClaim. New sets it to the registry of the App, and it defaults to the
+	// DefaultRegistry.
+	Registry *Registry
+}
+
+// useRegistry sets the registry if none is set. New calls it on the Authenticator of the Config.
+func (m *ClaimsMapping) useRegistry(reg *Registry) {
+	if m.Registry == nil {
+		m.Registry = reg
+	}
+}
+
+// Principal builds a principal from the subject and claims.
+func (m ClaimsMapping) Principal(subject string, claims map[string]interface{}) *Principal {
+	roleClaim, userKeyClaim, userKind := m.RoleClaim, m.UserKeyClaim, m.UserKind
+	if roleClaim == "" {
+		roleClaim = "role"
+	}
+	if userKeyClaim == "" {
+		userKeyClaim = "userId"
+	}
+	if userKind == "" {
+		userKind = "user"
+	}
+	reg := m.Registry
+	if reg == nil {
+		reg = DefaultRegistry
+	}
+
+	p := &Principal{Subject: subject, Claims: claims}
+
+	switch roles := claims[roleClaim].(type) {
+	case string:
+		p.Roles = []string{roles}
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				p.Roles = append(p.Roles, s)
+			}
+		}
+	case []string:
+		p.Roles = roles
+	}
+
+	switch id := claims[userKeyClaim].(type) {
+	case string:
+		if strings.HasPrefix(id, "/") {
+			p.Key = reg.Key(id)
+		} else if n, err := strconv.ParseInt(id, 10, 64); err == nil && !m.UserNames {
+			p.Key = datastore.IDKey(userKind, n, nil)
+		} else if id != "" {
+			p.Key = datastore.NameKey(userKind, id, nil)
+		}
+	case float64:
+		p.Key = datastore.IDKey(userKind, int64(id), nil)
+	case int64:
+		p.Key = datastore.IDKey(userKind, id, nil)
+	}
+	if p.Key != nil && p.Key.Incomplete() {
+		p.Key = nil
+	}
+
+	return p
+}
+
+// FirebaseAuthenticator verifies Firebase ID tokens.
+type FirebaseAuthenticator struct {
+	Client *firebaseAuth.Client
+	ClaimsMapping
+}
+
+// NewFirebaseAuthenticator returns a FirebaseAuthenticator using the client and default claims mapping.
+func NewFirebaseAuthenticator(client *firebaseAuth.Client) *FirebaseAuthenticator {
+	return &FirebaseAuthenticator{Client: client}
+}
+
+func (a *FirebaseAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	jwtToken := BearerToken(request)
+	if jwtToken == "" {
+		return nil, nil
+	}
+	if a.Client == nil {
+		return nil, errors.New("firebase auth client not initialized")
+	}
+
+	token, err := a.Client.VerifyIDToken(request.Context(), jwtToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Principal(token.UID, token.Claims), nil
+}
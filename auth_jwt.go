@@ -0,0 +1,281 @@
+package aeio
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTAuthenticator verifies JWTs locally against a set of keys, usually loaded from a JWKS file, so authentication
+// works offline. RS256/384/512, ES256/384/512 and HS256/384/512 are supported, each only with keys of its own type.
+type JWTAuthenticator struct {
+	// Keys by key id. A token without kid is accepted only if there is a single key.
+	// Values are *rsa.PublicKey, *ecdsa.PublicKey or []byte (HMAC secret).
+	Keys map[string]interface{}
+	// Audience must match the aud claim. It is required, otherwise a token the identity provider signed for any
+	// other application would be accepted.
+	Audience string
+	// Issuer, if set, must match the iss claim.
+	Issuer string
+	// Leeway tolerates clock skew on exp and nbf. Tokens without exp are refused.
+	Leeway time.Duration
+	ClaimsMapping
+}
+
+// NewJWKSFileAuthenticator returns a JWTAuthenticator with the keys of the JWKS file, accepting tokens for the
+// audience and, if not empty, from the issuer.
+func NewJWKSFileAuthenticator(path string, audience string, issuer string) (*JWTAuthenticator, error) {
+	if audience == "" {
+		return nil, errors.New("jwt audience is required")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTAuthenticator{Keys: keys, Audience: audience, Issuer: issuer}, nil
+}
+
+// ParseJWKS parses a JSON Web Key Set, returning the keys by key id.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("jwks key %s: unsupported curve %s", k.Kid, k.Crv)
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+			}
+			keys[k.Kid] = secret
+		default:
+			return nil, fmt.Errorf("jwks key %s: unsupported key type %s", k.Kid, k.Kty)
+		}
+	}
+	return keys, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	token := BearerToken(request)
+	if token == "" {
+		return nil, nil
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	return a.Principal(subject, claims), nil
+}
+
+// Verify checks the token signature and time, issuer and audience claims, returning the claims.
+func (a *JWTAuthenticator) Verify(token string) (map[string]interface{}, error) {
+	if a.Audience == "" {
+		return nil, errors.New("jwt authenticator without audience")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := a.Keys[header.Kid]
+	if !ok && header.Kid == "" && len(a.Keys) == 1 {
+		for _, k := range a.Keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key id %q", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("jwt without expiration")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.Leeway)) {
+		return nil, errors.New("jwt expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("jwt issuer mismatch")
+	}
+	if !jwtAudience(claims["aud"], a.Audience) {
+		return nil, errors.New("jwt audience mismatch")
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func jwtAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks the signature with the algorithm, refusing keys of a different type than the algorithm.
+func verifyJWTSignature(alg string, key interface{}, signed []byte, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("jwt key is not rsa")
+		}
+		h := hash.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("jwt key is not ecdsa")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid jwt signature")
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("jwt key is not a secret")
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported jwt algorithm %q", alg)
+}
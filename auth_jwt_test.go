@@ -0,0 +1,145 @@
+package aeio
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// signJWTForTest signs the claims with the SHA-256 variant of the algorithm, using the key whatever its type, so
+// tests can build tokens that don't match their keys.
+func signJWTForTest(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticatorVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+
+	a := &JWTAuthenticator{
+		Keys: map[string]interface{}{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+			"hs":  secret,
+		},
+		Audience: "app",
+		Issuer:   "issuer",
+		Leeway:   time.Minute,
+	}
+
+	now := time.Now()
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "user1",
+			"iss": "issuer",
+			"aud": "app",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	tamper := func(token string) string {
+		return token[:len(token)-4] + "AAAA"
+	}
+
+	tests := []struct {
+		name          string
+		authenticator *JWTAuthenticator
+		token         string
+		valid         bool
+	}{
+		{"rs256", a, signJWTForTest(t, "RS256", "rsa", rsaKey, claims(nil)), true},
+		{"es256", a, signJWTForTest(t, "ES256", "ec", ecKey, claims(nil)), true},
+		{"hs256", a, signJWTForTest(t, "HS256", "hs", secret, claims(nil)), true},
+		{"audience in list", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "app"} })), true},
+		{"expired within leeway", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-30 * time.Second).Unix() })), true},
+
+		{"hs256 with rsa public key as secret", a, signJWTForTest(t, "HS256", "rsa", rsaKey.PublicKey.N.Bytes(), claims(nil)), false},
+		{"rs256 with hmac key", a, signJWTForTest(t, "RS256", "hs", rsaKey, claims(nil)), false},
+		{"es256 with rsa key", a, signJWTForTest(t, "ES256", "rsa", ecKey, claims(nil)), false},
+		{"rs256 with ecdsa key", a, signJWTForTest(t, "RS256", "ec", rsaKey, claims(nil)), false},
+		{"alg none", a, signJWTForTest(t, "none", "hs", secret, claims(nil)), false},
+		{"unknown kid", a, signJWTForTest(t, "HS256", "other", secret, claims(nil)), false},
+
+		{"expired", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })), false},
+		{"without exp", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"not valid yet", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })), false},
+		{"other audience", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"without audience", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { delete(c, "aud") })), false},
+		{"other issuer", a, signJWTForTest(t, "HS256", "hs", secret, claims(func(c map[string]interface{}) { c["iss"] = "other" })), false},
+		{"authenticator without audience", &JWTAuthenticator{Keys: a.Keys}, signJWTForTest(t, "HS256", "hs", secret, claims(nil)), false},
+
+		{"rs256 bad signature", a, tamper(signJWTForTest(t, "RS256", "rsa", rsaKey, claims(nil))), false},
+		{"es256 bad signature", a, tamper(signJWTForTest(t, "ES256", "ec", ecKey, claims(nil))), false},
+		{"hs256 bad signature", a, tamper(signJWTForTest(t, "HS256", "hs", secret, claims(nil))), false},
+		{"rs256 signed by other key", a, signJWTForTest(t, "RS256", "rsa", otherRSAKey, claims(nil)), false},
+		{"hs256 signed by other secret", a, signJWTForTest(t, "HS256", "hs", []byte("other"), claims(nil)), false},
+		{"malformed", a, "not.a-jwt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.authenticator.Verify(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("expected valid token, got error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("expected error, got claims %v", got)
+			}
+		})
+	}
+}
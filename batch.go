@@ -0,0 +1,285 @@
+package aeio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// BatchPath is the path, after the router prefix, that takes batch requests. It can't clash with a kind path.
+const BatchPath = "/_batch"
+
+// DefaultBatchSizeMax is the default limit of operations of a batch request.
+const DefaultBatchSizeMax = 100
+
+// BatchRequest is the body of a POST to BatchPath. The operations run in order, through the same handlers,
+// middlewares and hooks of single requests. If Atomic, they run in one transaction and either all of them are done
+// or none. As datastore transactions don't see their own writes, operations of atomic batches read the entities as
+// they were before the batch, but may still reference the keys created by earlier operations.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is one operation of a batch. Path is a resource path, as returned in the key of resources, that
+// may start with a reference to the key of an earlier operation: "$0/invoice" is the invoice kind under the key of
+// the first operation, and "$company/invoice" under the one with the id "company". String values of Body starting
+// with a reference are replaced the same way. The conditional and list headers of the batch request are not passed to
+// the operations, only the ones in Headers.
+type BatchOperation struct {
+	ID      string            `json:"id,omitempty"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResult is the outcome of one operation, with its http status and the resource as it would be responded alone.
+type BatchResult struct {
+	ID       string    `json:"id,omitempty"`
+	Status   int       `json:"status"`
+	ETag     string    `json:"etag,omitempty"`
+	Resource *Resource `json:"resource"`
+}
+
+// BatchResponse is the body responded to batch requests.
+type BatchResponse struct {
+	Results     []*BatchResult `json:"results"`
+	Error       error          `json:"error"`
+	TimeElapsed int64          `json:"timeElapsed,omitempty"`
+}
+
+// serveBatch runs a batch request, writing the response itself unless it fails before running the operations.
+// Failed operations don't fail the batch unless it is atomic, when the batch takes the status of the failed operation
+// and the others are responded as 424 Failed Dependency.
+func (rt *Router) serveBatch(br *Resource, start time.Time) error {
+	app, writer, request := br.App(), br.Access.Writer, br.Access.Request
+	if request.Method != http.MethodPost {
+		return errorMethodNotAllowed.withHint("Batches are sent with POST").withStack(10)
+	}
+
+	body, err := br.Access.Body()
+	if err != nil {
+		return errorRequestBodyRead.withCause(err).withStack(10)
+	}
+	var batch BatchRequest
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		return errorRequestUnmarshal.withCause(err).withStack(10)
+	}
+	if len(batch.Operations) == 0 || len(batch.Operations) > app.Config.BatchSizeMax {
+		return errorBatchSize.withHint(fmt.Sprintf("Send from 1 to %d operations", app.Config.BatchSizeMax)).withStack(10)
+	}
+
+	response := &BatchResponse{}
+	status := http.StatusOK
+	if !batch.Atomic {
+		response.Results = rt.runBatch(app, request, br.Access.Principal, batch.Operations, nil)
+	} else {
+		failed := -1
+		err = app.RunInTransaction(request.Context(), func(tx Transaction) error {
+			response.Results = rt.runBatch(app, request, br.Access.Principal, batch.Operations, tx)
+			for i, result := range response.Results {
+				if result.Resource.error != nil {
+					failed = i
+					return result.Resource.error
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if failed >= 0 {
+				status = response.Results[failed].Status
+				response.Error = errorBatchAborted.withCause(err).withCode(status).withHint(fmt.Sprintf("Operation %d failed", failed)).withStack(10)
+			} else {
+				// the operations went well, but the commit didn't
+				status = http.StatusInternalServerError
+				response.Error = errorDatastorePut.withCause(err).withStack(10)
+			}
+			// operations after the failed one never ran, but are responded too, keeping results aligned
+			for _, op := range batch.Operations[len(response.Results):] {
+				response.Results = append(response.Results, &BatchResult{ID: op.ID, Resource: &Resource{}})
+			}
+			for i, result := range response.Results {
+				if i != failed {
+					result.Status = result.Resource.setError(errorBatchAborted.withStack(10))
+					result.ETag = ""
+				}
+			}
+		}
+	}
+	response.TimeElapsed = int64(time.Since(start) / time.Millisecond)
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(status)
+	log.Printf("%d %s %s (%d operations)", status, request.Method, request.URL.Path, len(batch.Operations))
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		_ = errorResponseMarshal.withCause(err).withStack(10).withLog()
+	}
+	_, err = writer.Write(j)
+	if err != nil {
+		_ = errorResponseWrite.withCause(err).withStack(10).withLog()
+	}
+	return nil
+}
+
+// runBatch runs the operations in order, in the transaction if not nil, stopping at the first failure if so.
+func (rt *Router) runBatch(app *App, request *http.Request, principal *Principal, operations []BatchOperation, tx Transaction) []*BatchResult {
+	refs := make(map[string]*datastore.Key)
+	results := make([]*BatchResult, 0, len(operations))
+	for i, op := range operations {
+		result := rt.runBatchOperation(app, request, principal, op, refs, tx)
+		results = append(results, result)
+		if result.Resource.error != nil {
+			if tx != nil {
+				break
+			}
+			continue
+		}
+		if result.Resource.Key != nil && !result.Resource.Key.Incomplete() {
+			refs[strconv.Itoa(i)] = result.Resource.Key
+			if op.ID != "" {
+				refs[op.ID] = result.Resource.Key
+			}
+		}
+	}
+	return results
+}
+
+func (rt *Router) runBatchOperation(app *App, request *http.Request, principal *Principal, op BatchOperation, refs map[string]*datastore.Key, tx Transaction) *BatchResult {
+	start := time.Now()
+	result := &BatchResult{ID: op.ID, Resource: &Resource{}}
+	bw := &batchWriter{header: make(http.Header)}
+	writer := http.ResponseWriter(bw)
+
+	path, ok := batchResolve(op.Path, refs)
+	if !ok {
+		result.Status = result.Resource.setError(errorBatchReference.withCause(fmt.Errorf("unknown reference in %s", op.Path)).withStack(10))
+		return result
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		result.Status = result.Resource.setError(errorInvalidPath.withCause(err).withStack(10))
+		return result
+	}
+
+	body := []byte(op.Body)
+	if len(body) > 0 {
+		// numbers are kept as they are written, as float64 would round the int64 ones over 2^53, like ids
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			result.Status = result.Resource.setError(errorRequestUnmarshal.withCause(err).withStack(10))
+			return result
+		}
+		body, err = json.Marshal(batchResolveValue(value, refs))
+		if err != nil {
+			result.Status = result.Resource.setError(errorRequestUnmarshal.withCause(err).withStack(10))
+			return result
+		}
+	}
+
+	sub := request.Clone(request.Context())
+	sub.Method = strings.ToUpper(op.Method)
+	sub.URL = u
+	sub.RequestURI = ""
+	sub.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	for _, h := range []string{"If-Match", "If-None-Match", "X-Next", "X-Size", "X-Filters", "X-Sorters", "X-Counter", "X-Consistency"} {
+		sub.Header.Del(h)
+	}
+	for k, v := range op.Headers {
+		sub.Header.Set(k, v)
+	}
+
+	r, err := app.newResourceFromPath(&writer, sub, u.EscapedPath())
+	result.Resource = r
+	if err != nil {
+		result.Status = r.setError(err)
+		return result
+	}
+	r.Access.Principal = principal
+	r.UseTransaction(tx)
+	defer r.UseTransaction(nil)
+
+	action, err := routeAction(sub, r.Key)
+	if err != nil {
+		result.Status = r.setError(err)
+		return result
+	}
+	handler := rt.handler(r.Key.Kind, action)
+	if handler == nil {
+		result.Status = r.setError(errorMethodNotAllowed.withStack(10))
+		return result
+	}
+
+	err = handler(r)
+	r.Timing(start)
+	result.Status = r.setError(err)
+	result.ETag = bw.header.Get("ETag")
+	return result
+}
+
+// batchResolve replaces a reference at the start of s by the path of the referenced key.
+// Strings not starting with $ are returned as they are.
+func batchResolve(s string, refs map[string]*datastore.Key) (string, bool) {
+	if !strings.HasPrefix(s, "$") {
+		return s, true
+	}
+	name, rest := s[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	k, ok := refs[name]
+	if !ok {
+		return s, false
+	}
+	return Path(k) + rest, true
+}
+
+// batchResolveValue replaces the references in the strings of a decoded json value. Unknown references are left
+// as they are, as they may be just text.
+func batchResolveValue(value interface{}, refs map[string]*datastore.Key) interface{} {
+	switch v := value.(type) {
+	case string:
+		s, _ := batchResolve(v, refs)
+		return s
+	case []interface{}:
+		for i := range v {
+			v[i] = batchResolveValue(v[i], refs)
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = batchResolveValue(v[k], refs)
+		}
+	}
+	return value
+}
+
+// batchWriter keeps the headers set by the actions of an operation, like the ETag. Nothing is written by them.
+type batchWriter struct {
+	header http.Header
+}
+
+func (w *batchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *batchWriter) WriteHeader(int) {}
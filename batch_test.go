@@ -0,0 +1,153 @@
+package aeio
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// batchTestResults returns the results of a batch response.
+func batchTestResults(t *testing.T, response map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	list, _ := response["results"].([]interface{})
+	results := make([]map[string]interface{}, len(list))
+	for i := range list {
+		results[i], _ = list[i].(map[string]interface{})
+	}
+	return results
+}
+
+func TestBatchReferences(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("/api")
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/api/_batch", `{"operations":[
+		{"id":"acme","method":"POST","path":"/rtcompany","body":{"name":"acme"}},
+		{"method":"POST","path":"$acme/rtinvoice","body":{"total":9007199254740993,"status":"$acme"}},
+		{"method":"GET","path":"$1"},
+		{"method":"POST","path":"$9/rtinvoice","body":{}},
+		{"method":"PATCH","path":"$0","body":{"name":"$unknown"}}
+	]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %v", w.Code, res)
+	}
+	results := batchTestResults(t, res)
+	if len(results) != 5 {
+		t.Fatalf("got %d results, want 5: %v", len(results), res)
+	}
+
+	for i, status := range []float64{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusBadRequest, http.StatusOK} {
+		if results[i]["status"] != status {
+			t.Fatalf("operation %d has status %v, want %v: %v", i, results[i]["status"], status, results[i])
+		}
+	}
+	if results[0]["id"] != "acme" || results[0]["etag"] == nil {
+		t.Fatalf("operation 0 misses id or etag: %v", results[0])
+	}
+
+	company, _ := results[0]["resource"].(map[string]interface{})["key"].(string)
+	invoice, _ := results[2]["resource"].(map[string]interface{})
+	data := routerTestData(invoice)
+	if invoice["key"] != results[1]["resource"].(map[string]interface{})["key"] || data["status"] != company {
+		t.Fatalf("references not resolved: %v", results)
+	}
+	if name := routerTestData(results[4]["resource"].(map[string]interface{}))["name"]; name != "$unknown" {
+		t.Fatalf("unknown reference in body changed to %v", name)
+	}
+
+	// the response decoding rounds the number, so it is checked in the store
+	var stored routerTestInvoice
+	err := app.Store.Get(context.Background(), app.Registry.Key(invoice["key"].(string)), &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Total != 9007199254740993 {
+		t.Fatalf("stored total %d, want 9007199254740993", stored.Total)
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("")
+	count := func(kind string) int {
+		n, err := app.Store.Count(context.Background(), NewQuery(kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/_batch", `{"atomic":true,"operations":[
+		{"id":"acme","method":"POST","path":"/rtcompany","body":{"name":"acme"}},
+		{"method":"POST","path":"$acme/rtinvoice","body":{"total":5}}
+	]}`, nil)
+	if w.Code != http.StatusOK || count("rtcompany") != 1 || count("rtinvoice") != 1 {
+		t.Fatalf("atomic batch: %d %v", w.Code, res)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodPost, "/_batch", `{"atomic":true,"operations":[
+		{"id":"other","method":"POST","path":"/rtcompany","body":{"name":"other"}},
+		{"method":"POST","path":"$other/rtinvoice","body":{"total":5}},
+		{"method":"PATCH","path":"/rtcompany/77","body":{"name":"missing"}},
+		{"id":"never","method":"POST","path":"/rtcompany","body":{"name":"never"}}
+	]}`, nil)
+	if w.Code != http.StatusNotFound || res["error"] == nil {
+		t.Fatalf("failed atomic batch: %d %v", w.Code, res)
+	}
+	if count("rtcompany") != 1 || count("rtinvoice") != 1 {
+		t.Fatalf("failed atomic batch was not rolled back: %d companies, %d invoices", count("rtcompany"), count("rtinvoice"))
+	}
+	results := batchTestResults(t, res)
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4: %v", len(results), res)
+	}
+	for i, status := range []float64{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound, http.StatusFailedDependency} {
+		if results[i]["status"] != status {
+			t.Fatalf("operation %d has status %v, want %v: %v", i, results[i]["status"], status, results[i])
+		}
+	}
+	if results[3]["id"] != "never" || results[0]["etag"] != nil {
+		t.Fatalf("rolled back results keep their etag or lose their id: %v", results)
+	}
+}
+
+func TestBatchRequest(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("")
+	calls := 0
+	rt.Use(func(next Handler) Handler {
+		return func(r *Resource) error {
+			calls++
+			if r.Access.Request.Header.Get("X-Tenant") == "" {
+				return errorForbidden.withCause(errors.New("no tenant")).withStack(10)
+			}
+			return next(r)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header map[string]string
+		code   int
+		calls  int
+	}{
+		{"middleware runs for the batch", http.MethodPost, `{"operations":[{"method":"GET","path":"/rtcompany"}]}`, nil, http.StatusForbidden, 1},
+		{"middleware runs for each operation", http.MethodPost, `{"operations":[{"method":"GET","path":"/rtcompany"},{"method":"GET","path":"/rtcompany"}]}`, map[string]string{"X-Tenant": "t"}, http.StatusOK, 3},
+		{"get", http.MethodGet, "", map[string]string{"X-Tenant": "t"}, http.StatusMethodNotAllowed, 1},
+		{"no operations", http.MethodPost, `{"operations":[]}`, map[string]string{"X-Tenant": "t"}, http.StatusBadRequest, 1},
+		{"invalid body", http.MethodPost, `{"operations":`, map[string]string{"X-Tenant": "t"}, http.StatusBadRequest, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			w, res := routerTestServe(t, rt, tt.method, "/_batch", tt.body, tt.header)
+			if w.Code != tt.code || calls != tt.calls {
+				t.Fatalf("got %d with %d middleware calls, want %d with %d: %v", w.Code, calls, tt.code, tt.calls, res)
+			}
+		})
+	}
+}
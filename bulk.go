@@ -0,0 +1,421 @@
+package aeio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultBulkSizeMax is the default limit of items of bulk requests.
+const DefaultBulkSizeMax = 5000
+
+// BulkUpdate is one item of an UpdateMany request: the key path of the resource, the data to patch it with, and
+// optionally the ETag it must still have.
+type BulkUpdate struct {
+	Key  string          `json:"key"`
+	ETag string          `json:"etag,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// CreateMany creates the resources of the json array in the request body, under the resource key, an incomplete one
+// like for Create. Each item is authorized, bound, hooked and checked by rules like in Create, but the entities are
+// put together with PutMulti, in chunks of MultiSizeMax. Items are listed in Resources with their own errors, and
+// failures of some of them don't stop the others, making the request fail with a 207.
+func (r *Resource) CreateMany() error {
+	var err error
+	r.EnterAction(ActionCreateMany)
+	defer r.ExitAction(ActionCreateMany)
+
+	if !r.Key.Incomplete() {
+		return errorInvalidPath.withHint("Bulk creation works under models, not ids: remove the id from the end of path").withStack(10).withLog()
+	}
+
+	err = r.App().Registry.ValidateKey(r.Key)
+	if err != nil {
+		return errorInvalidPath.withCause(err).withStack(10).withLog()
+	}
+
+	if r.App().Registry.KeyType(r.Key.Kind) == KeyTypeName {
+		return errorInvalidPath.withCause(errors.New("kind " + r.Key.Kind + " uses name keys, that can't be allocated")).withStack(10).withLog()
+	}
+
+	if err = r.authorizeAction(ActionCreateMany); err != nil {
+		return err
+	}
+
+	// the items share the parent, so it is checked once
+	if err = r.checkStrictParents(); err != nil {
+		return err
+	}
+
+	var items []json.RawMessage
+	if err = r.bindBulkItems(&items); err != nil {
+		return err
+	}
+
+	var pending []*Resource
+	for _, item := range items {
+		nr := r.bulkItem(datastore.IncompleteKey(r.Key.Kind, r.Key.Parent))
+		err = nr.prepareCreate(item)
+		if err != nil {
+			nr.setError(err)
+			continue
+		}
+		pending = append(pending, nr)
+	}
+
+	r.putMany(pending)
+	return r.bulkResult()
+}
+
+func (r *Resource) prepareCreate(item json.RawMessage) error {
+	if err := r.authorizeAction(ActionCreate); err != nil {
+		return err
+	}
+
+	if err := r.BindData(item); err != nil {
+		return err
+	}
+
+	if data, ok := r.Data.(DataBeforeSave); ok {
+		err := data.BeforeSave(r)
+		if err != nil {
+			return errorUnknown.withCause(err).withStack(10).withLog()
+		}
+	}
+
+	if err := r.checkActionRules(ActionCreate); err != nil {
+		return err
+	}
+
+	r.Version = 0
+	r.touch()
+	return nil
+}
+
+// UpdateMany patches the resources listed as BulkUpdate items in the request body, all of the resource kind and
+// under its parent. The entities are read with GetMulti and put with PutMulti, but each item is authorized, bound,
+// hooked and checked by rules like in Update. Unlike Update, the reads and writes are not done in a transaction, so
+// send the ETag of items that must not be overwritten if changed meanwhile. Failures are reported like in CreateMany.
+func (r *Resource) UpdateMany() error {
+	var err error
+	r.EnterAction(ActionUpdateMany)
+	defer r.ExitAction(ActionUpdateMany)
+
+	if err = r.validateBulkKey(); err != nil {
+		return err
+	}
+
+	if err = r.authorizeAction(ActionUpdateMany); err != nil {
+		return err
+	}
+
+	var items []BulkUpdate
+	if err = r.bindBulkItems(&items); err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	loaded := r.loadMany(keys, ActionUpdate)
+
+	// Resources has an item for each key, in order
+	index := make(map[*Resource]int)
+	for i, nr := range r.Resources {
+		index[nr] = i
+	}
+
+	var pending []*Resource
+	for _, nr := range loaded {
+		err = nr.prepareUpdate(items[index[nr]])
+		if err != nil {
+			nr.setError(err)
+			continue
+		}
+		pending = append(pending, nr)
+	}
+
+	r.putMany(pending)
+	return r.bulkResult()
+}
+
+// prepareUpdate binds the item to the loaded resource. Like in Update, the stored data is checked by the rules before
+// the ETag, and items failing them drop it, so their result doesn't show what the caller can't change.
+func (r *Resource) prepareUpdate(item BulkUpdate) error {
+	// the stored data must also satisfy the rules, so a caller can't take over someone else's entity
+	if err := r.checkActionRules(ActionUpdate); err != nil {
+		return err
+	}
+
+	if item.ETag != "" && !etagMatch(item.ETag, r.ETag(), false) {
+		return errorPreconditionFailed.withHint("The entity changed, get it again to have the current ETag").withStack(10)
+	}
+
+	if err := r.BindData(item.Data); err != nil {
+		return err
+	}
+
+	if data, ok := r.Data.(DataBeforeSave); ok {
+		err := data.BeforeSave(r)
+		if err != nil {
+			return errorUnknown.withCause(err).withStack(10).withLog()
+		}
+	}
+
+	if err := r.checkActionRules(ActionUpdate); err != nil {
+		return err
+	}
+
+	r.touch()
+	return nil
+}
+
+// DeleteMany deletes the resources whose key paths are listed in the json array of the request body, all of the
+// resource kind and under its parent. Like UpdateMany, it works with GetMulti and DeleteMulti, but authorizes, hooks
+// and checks each item like Delete. Failures are reported like in CreateMany.
+func (r *Resource) DeleteMany() error {
+	var err error
+	r.EnterAction(ActionDeleteMany)
+	defer r.ExitAction(ActionDeleteMany)
+
+	if err = r.validateBulkKey(); err != nil {
+		return err
+	}
+
+	if err = r.authorizeAction(ActionDeleteMany); err != nil {
+		return err
+	}
+
+	var keys []string
+	if err = r.bindBulkItems(&keys); err != nil {
+		return err
+	}
+
+	var pending []*Resource
+	for _, nr := range r.loadMany(keys, ActionDelete) {
+		err = nr.prepareDelete()
+		if err != nil {
+			nr.setError(err)
+			continue
+		}
+		pending = append(pending, nr)
+	}
+
+	for start := 0; start < len(pending); start += MultiSizeMax {
+		chunk := pending[start:minInt(start+MultiSizeMax, len(pending))]
+		keys := make([]*datastore.Key, len(chunk))
+		for i, nr := range chunk {
+			keys[i] = nr.Key
+		}
+
+		err = r.storeDeleteMulti(keys)
+		errs, multi := err.(datastore.MultiError)
+		for i, nr := range chunk {
+			if multi && errs[i] != nil {
+				nr.setError(errorDatastoreDelete.withCause(errs[i]).withStack(10))
+				continue
+			}
+			if err != nil && !multi {
+				nr.setError(errorDatastoreDelete.withCause(err).withStack(10))
+				continue
+			}
+			if data, ok := nr.Data.(DataAfterDelete); ok {
+				err := data.AfterDelete(nr)
+				if err != nil {
+					nr.setError(errorUnknown.withCause(err).withStack(10))
+				}
+			}
+		}
+	}
+
+	return r.bulkResult()
+}
+
+// prepareDelete checks the loaded resource like Delete. Items failing the rules drop the stored data.
+func (r *Resource) prepareDelete() error {
+	if err := r.checkActionRules(ActionDelete); err != nil {
+		return err
+	}
+
+	if data, ok := r.Data.(DataBeforeDelete); ok {
+		err := data.BeforeDelete(r)
+		if err != nil {
+			return errorUnknown.withCause(err).withStack(10).withLog()
+		}
+	}
+	return nil
+}
+
+// validateBulkKey checks the resource key of bulk updates and deletes, that must be the incomplete key of the kind.
+func (r *Resource) validateBulkKey() error {
+	if !r.Key.Incomplete() {
+		return errorInvalidPath.withHint("Bulk requests work under models, not ids: remove the id from the end of path").withStack(10).withLog()
+	}
+
+	err := r.App().Registry.ValidateKey(r.Key)
+	if err != nil {
+		return errorInvalidPath.withCause(err).withStack(10).withLog()
+	}
+	return nil
+}
+
+// bindBulkItems unmarshals the json array of the request body into items, a pointer to a slice, checking its size.
+func (r *Resource) bindBulkItems(items interface{}) error {
+	if r.Access.Request.ContentLength < 2 {
+		return errorEmptyRequestBody.withStack(10)
+	}
+
+	body, err := r.Access.Body()
+	if err != nil {
+		return errorRequestBodyRead.withCause(err).withStack(10)
+	}
+
+	var raw []json.RawMessage
+	err = json.Unmarshal(body, &raw)
+	if err != nil {
+		return errorRequestUnmarshal.withCause(err).withStack(10)
+	}
+	if len(raw) == 0 || len(raw) > r.App().Config.BulkSizeMax {
+		return errorBulkSize.withHint(fmt.Sprintf("Send from 1 to %d items", r.App().Config.BulkSizeMax)).withStack(10)
+	}
+
+	err = json.Unmarshal(body, items)
+	if err != nil {
+		return errorRequestUnmarshal.withCause(err).withStack(10)
+	}
+	return nil
+}
+
+// bulkItem returns a resource for one item of a bulk action, listed in Resources. It shares the Access, the
+// transaction and the action of r, so its rules and permissions are checked as if called directly.
+func (r *Resource) bulkItem(key *datastore.Key) *Resource {
+	nr := &Resource{
+		Key:          key,
+		Access:       r.Access,
+		ActionsStack: append([]string(nil), r.ActionsStack...),
+		tx:           r.tx,
+	}
+	r.Resources = append(r.Resources, nr)
+	return nr
+}
+
+// loadMany lists a bulk item in Resources for each key path, returning the ones that are valid, authorized for the
+// action and loaded, in the order of the paths. The others get their error.
+func (r *Resource) loadMany(paths []string, action string) []*Resource {
+	var valid []*Resource
+	for _, path := range paths {
+		k := r.App().Registry.Key(path)
+		nr := r.bulkItem(k)
+		if k == nil || k.Incomplete() || k.Kind != r.Key.Kind || !k.Parent.Equal(r.Key.Parent) {
+			nr.Key = nil
+			nr.setError(errorInvalidPath.withHint(fmt.Sprintf("%s is not an id of %s", path, Path(r.Key))).withStack(10))
+			continue
+		}
+		if err := nr.authorizeAction(action); err != nil {
+			nr.setError(err)
+			continue
+		}
+
+		var err error
+		nr.Data, err = r.App().Registry.NewObject(k.Kind)
+		if err != nil {
+			nr.setError(errorUnknown.withCause(err).withStack(10))
+			continue
+		}
+		if data, ok := nr.Data.(DataBeforeLoad); ok {
+			err = data.BeforeLoad(nr)
+			if err != nil {
+				nr.setError(errorUnknown.withCause(err).withStack(10))
+				continue
+			}
+		}
+		valid = append(valid, nr)
+	}
+
+	var loaded []*Resource
+	for start := 0; start < len(valid); start += MultiSizeMax {
+		chunk := valid[start:minInt(start+MultiSizeMax, len(valid))]
+		keys := make([]*datastore.Key, len(chunk))
+		for i, nr := range chunk {
+			keys[i] = nr.Key
+		}
+
+		err := r.storeGetMulti(keys, chunk)
+		errs, multi := err.(datastore.MultiError)
+		for i, nr := range chunk {
+			if multi && errs[i] != nil {
+				nr.setError(errorDatastoreRead.withCause(errs[i]).withStack(10))
+				continue
+			}
+			if err != nil && !multi {
+				nr.setError(errorDatastoreRead.withCause(err).withStack(10))
+				continue
+			}
+			if data, ok := nr.Data.(DataAfterLoad); ok {
+				err := data.AfterLoad(nr)
+				if err != nil {
+					nr.setError(errorUnknown.withCause(err).withStack(10))
+					continue
+				}
+			}
+			loaded = append(loaded, nr)
+		}
+	}
+	return loaded
+}
+
+// putMany puts the bulk items with PutMulti in chunks, running AfterSave on the ones saved.
+func (r *Resource) putMany(items []*Resource) {
+	for start := 0; start < len(items); start += MultiSizeMax {
+		chunk := items[start:minInt(start+MultiSizeMax, len(items))]
+		keys := make([]*datastore.Key, len(chunk))
+		for i, nr := range chunk {
+			keys[i] = nr.Key
+		}
+
+		keys, err := r.storePutMulti(keys, chunk)
+		errs, multi := err.(datastore.MultiError)
+		for i, nr := range chunk {
+			if multi && errs[i] != nil {
+				nr.setError(errorDatastorePut.withCause(errs[i]).withStack(10))
+				continue
+			}
+			if err != nil && !multi {
+				nr.setError(errorDatastorePut.withCause(err).withStack(10))
+				continue
+			}
+			nr.Key = keys[i]
+			if data, ok := nr.Data.(DataAfterSave); ok {
+				err := data.AfterSave(nr)
+				if err != nil {
+					nr.setError(errorUnknown.withCause(err).withStack(10))
+				}
+			}
+		}
+	}
+}
+
+// bulkResult fails with a 207 if any item failed.
+func (r *Resource) bulkResult() error {
+	failed := 0
+	for _, nr := range r.Resources {
+		if nr.error != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errorBulkPartial.withHint(fmt.Sprintf("%d of %d items failed", failed, len(r.Resources))).withStack(10)
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,152 @@
+package aeio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// bulkTestResources returns the items of a bulk response.
+func bulkTestResources(t *testing.T, response map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	list, _ := response["resources"].([]interface{})
+	resources := make([]map[string]interface{}, len(list))
+	for i := range list {
+		resources[i], _ = list[i].(map[string]interface{})
+	}
+	return resources
+}
+
+func newBulkTestApp(t *testing.T) *App {
+	t.Helper()
+	reg := NewRegistry()
+	reg.RegisterModel("bcompany", routerTestCompany{})
+	reg.RegisterModel("binvoice", rulesTestInvoice{})
+	reg.RegisterChild("", "bcompany")
+	reg.RegisterChild("bcompany", "binvoice")
+	reg.RegisterRule("binvoice", ActionUpdate, `data.customerId == claims.userId`)
+	reg.RegisterRule("binvoice", ActionDelete, `data.customerId == claims.userId`)
+	app, err := New(Config{Store: NewMemoryStore(), Registry: reg, DisableFirebase: true, Authenticator: rulesTestAuthenticator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+func TestCreateMany(t *testing.T) {
+	app := newBulkTestApp(t)
+	rt := app.NewRouter("")
+
+	// more than a PutMulti chunk, with a bad item in the middle
+	items := make([]string, MultiSizeMax+10)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"customerId":"7","total":%d}`, i)
+	}
+	items[3] = `{"total":"bad"}`
+	w, res := routerTestServe(t, rt, http.MethodPost, "/bcompany/1/binvoice", "["+strings.Join(items, ",")+"]", nil)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("got %d, want 207: %v", w.Code, res["error"])
+	}
+	resources := bulkTestResources(t, res)
+	if len(resources) != len(items) {
+		t.Fatalf("got %d items, want %d", len(resources), len(items))
+	}
+	for i, item := range resources {
+		if (item["error"] != nil) != (i == 3) {
+			t.Fatalf("item %d has error %v", i, item["error"])
+		}
+	}
+	if last := routerTestData(resources[len(items)-1])["total"]; last != float64(len(items)-1) {
+		t.Fatalf("last item has total %v, items are out of order", last)
+	}
+
+	n, err := app.Store.Count(context.Background(), NewQuery("binvoice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(items)-1 {
+		t.Fatalf("created %d, want %d", n, len(items)-1)
+	}
+
+	w, _ = routerTestServe(t, rt, http.MethodPost, "/bcompany/1/binvoice", `[]`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("empty bulk: %d", w.Code)
+	}
+}
+
+func TestUpdateManyAndDeleteMany(t *testing.T) {
+	app := newBulkTestApp(t)
+	rt := app.NewRouter("")
+	owner := map[string]string{"X-Test-User": "7"}
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/bcompany/1/binvoice", `[
+		{"customerId":"7","total":1},{"customerId":"8","total":2},{"customerId":"7","total":3}
+	]`, owner)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %v", w.Code, res)
+	}
+	created := bulkTestResources(t, res)
+	own, others, stale := created[0]["key"].(string), created[1]["key"].(string), created[2]["key"].(string)
+
+	w, res = routerTestServe(t, rt, http.MethodPatch, "/bcompany/1/binvoice", fmt.Sprintf(`[
+		{"key":%q,"data":{"total":10}},
+		{"key":%q,"data":{"total":20}},
+		{"key":"/bcompany/1/binvoice/999","data":{"total":30}},
+		{"key":"/bcompany/2/binvoice/1","data":{"total":40}},
+		{"key":%q,"etag":"\"9-0\"","data":{"total":50}}
+	]`, own, others, stale), owner)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("update: got %d, want 207: %v", w.Code, res)
+	}
+	updated := bulkTestResources(t, res)
+	tests := []struct {
+		name    string
+		failed  bool
+		hasData bool
+	}{
+		{"own", false, true},
+		{"other's", true, false},
+		{"missing", true, false},
+		{"other parent", true, false},
+		{"stale etag", true, true},
+	}
+	for i, tt := range tests {
+		if (updated[i]["error"] != nil) != tt.failed {
+			t.Fatalf("update of %s item has error %v", tt.name, updated[i]["error"])
+		}
+		if _, ok := updated[i]["data"]; ok != tt.hasData {
+			t.Fatalf("update of %s item responded data %v", tt.name, updated[i]["data"])
+		}
+	}
+	if total := routerTestData(updated[0])["total"]; total != 10.0 {
+		t.Fatalf("own item updated to %v", total)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodGet, others, "", nil)
+	if w.Code != http.StatusOK || routerTestData(res)["total"] != 2.0 {
+		t.Fatalf("other's item changed: %d %v", w.Code, res)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodDelete, "/bcompany/1/binvoice", fmt.Sprintf(`[%q,%q]`, own, others), owner)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("delete: got %d, want 207: %v", w.Code, res)
+	}
+	deleted := bulkTestResources(t, res)
+	if deleted[0]["error"] != nil || deleted[1]["error"] == nil {
+		t.Fatalf("delete results: %v", deleted)
+	}
+	if _, ok := deleted[1]["data"]; ok {
+		t.Fatalf("denied delete responded data %v", deleted[1]["data"])
+	}
+	w, _ = routerTestServe(t, rt, http.MethodGet, own, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("own item not deleted: %d", w.Code)
+	}
+	w, _ = routerTestServe(t, rt, http.MethodGet, others, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("other's item deleted: %d", w.Code)
+	}
+}
@@ -10,6 +10,8 @@ import (
 )
 
 const (
+	errApp       = "error_app"
+	errAuth      = "error_auth"
 	errDatastore = "error_datastore"
 	errKey       = "error_key"
 	errMarshal   = "error_marshal"
@@ -23,6 +25,22 @@ const (
 )
 
 var (
+	errorAppInit = &complexError{
+		Name: errApp,
+		Desc: "The application could not be initialized",
+		Code: http.StatusInternalServerError,
+	}
+	errorUnauthorized = &complexError{
+		Name: errAuth,
+		Desc: "The credentials of the request could not be verified",
+		Hint: "Send a valid token in the Authorization header as Bearer",
+		Code: http.StatusUnauthorized,
+	}
+	errorForbidden = &complexError{
+		Name: errAuth,
+		Desc: "The caller is not allowed to do this action on this resource",
+		Code: http.StatusForbidden,
+	}
 	errorInvalidPath = &complexError{
 		Name: errKey,
 		Desc: "The path used is not valid",
@@ -43,8 +61,15 @@ var (
 		Desc: "Could not delete in datastore",
 		Code: http.StatusInternalServerError,
 	}
+	errorDatastoreConflict = &complexError{
+		Name: errDatastore,
+		Desc: "There is already an entity with this key",
+		Hint: "Use PUT to replace it, or allocate a new key",
+		Code: http.StatusConflict,
+	}
 	errorDatastoreCount = &complexError{
 		Name: errDatastore,
+		Desc: "Could not check the existence of entities in datastore",
 		Code: http.StatusInternalServerError,
 	}
 	errorDatastoreAncestorNotFound = &complexError{
@@ -99,6 +124,70 @@ var (
 		Hint: "Check that the request is of the right method and valid json",
 		Code: http.StatusBadRequest,
 	}
+	errorMethodNotAllowed = &complexError{
+		Name: errRequest,
+		Desc: "The method is not allowed on this path",
+		Hint: "Use POST or GET on kinds, and GET, PATCH, PUT or DELETE on ids",
+		Code: http.StatusMethodNotAllowed,
+	}
+	errorPreconditionFailed = &complexError{
+		Name: errRequest,
+		Desc: "The If-Match or If-None-Match condition of the request failed",
+		Code: http.StatusPreconditionFailed,
+	}
+	errorNotModified = &complexError{
+		Name: errRequest,
+		Desc: "The entity didn't change",
+		Code: http.StatusNotModified,
+	}
+	errorBatchSize = &complexError{
+		Name: errRequest,
+		Desc: "The batch has no operations or too many of them",
+		Code: http.StatusBadRequest,
+	}
+	errorBatchReference = &complexError{
+		Name: errRequest,
+		Desc: "The operation references a key not created by an earlier operation of the batch",
+		Hint: "References are $ followed by the index or id of an earlier operation, like $0/child",
+		Code: http.StatusBadRequest,
+	}
+	errorBatchAborted = &complexError{
+		Name: errRequest,
+		Desc: "The atomic batch failed, so none of its operations was done",
+		Code: http.StatusFailedDependency,
+	}
+	errorBulkSize = &complexError{
+		Name: errRequest,
+		Desc: "The bulk request has no items or too many of them",
+		Hint: "Send a json array with the items",
+		Code: http.StatusBadRequest,
+	}
+	errorBulkPartial = &complexError{
+		Name: errRequest,
+		Desc: "Some items of the bulk request failed, see the error of each resource",
+		Code: http.StatusMultiStatus,
+	}
+	errorDatastoreMissingIndex = &complexError{
+		Name: errDatastore,
+		Desc: "The list needs a composite index that datastore doesn't have",
+		Code: http.StatusBadRequest,
+	}
+	errorInvalidListQuery = &complexError{
+		Name: errRequest,
+		Desc: "The filters or sorts of the list are not valid",
+		Code: http.StatusBadRequest,
+	}
+	errorInvalidFields = &complexError{
+		Name: errRequest,
+		Desc: "The fields asked are not fields of the model",
+		Code: http.StatusBadRequest,
+	}
+	errorRouteNotFound = &complexError{
+		Name: errRequest,
+		Desc: "The path is not served by this router",
+		Hint: "Verify the mount prefix of the router",
+		Code: http.StatusNotFound,
+	}
 	errorRequestBodyRead = &complexError{
 		Name: errRequest,
 		Desc: "Error reading request body",
@@ -126,6 +215,11 @@ func (e complexError) Error() string {
 	// return fmt.Sprintf(`name: "%s", description: "%s", hint: "%s", code: "%d", debug: "%s"`, e.Name, e.Desc, e.Hint, e.Code, e.Debug)
 }
 
+// Unwrap gives the cause to errors.Is and errors.As.
+func (e complexError) Unwrap() error {
+	return e.cause
+}
+
 func (e complexError) withCause(cause error) complexError {
 	e.cause = cause
 	e.Debug = cause.Error()
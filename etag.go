@@ -0,0 +1,88 @@
+package aeio
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag is the entity tag of the stored version of the resource, built from its Version and UpdatedAt so a deleted
+// and recreated entity doesn't repeat the tags of the old one.
+func (r *Resource) ETag() string {
+	return fmt.Sprintf(`"%d-%x"`, r.Version, r.UpdatedAt.UnixNano())
+}
+
+// touch marks a new version of the resource, right before saving it.
+// UpdatedAt is truncated to the datastore precision, so the ETag doesn't change after a reload.
+func (r *Resource) touch() {
+	r.Version++
+	r.UpdatedAt = time.Now().Truncate(time.Microsecond)
+}
+
+// setETag writes the ETag header for actions called directly.
+func (r *Resource) setETag() {
+	if len(r.ActionsStack) > 1 || r.Access == nil || r.Access.Writer == nil {
+		return
+	}
+	r.Access.Writer.Header().Set("ETag", r.ETag())
+}
+
+// checkPreconditions applies the If-Match and If-None-Match headers of actions called directly to the stored entity,
+// or to the lack of it if exists is false. Failed conditions are a 304 for reads and a 412 for writes.
+func (r *Resource) checkPreconditions(exists bool) error {
+	if len(r.ActionsStack) > 1 || r.Access == nil || r.Access.Request == nil {
+		return nil
+	}
+
+	etag := ""
+	if exists {
+		etag = r.ETag()
+	}
+
+	header := r.Access.Request.Header
+	if m := header.Get("If-Match"); m != "" && !etagMatch(m, etag, false) {
+		return errorPreconditionFailed.withHint("The entity changed, get it again to have the current ETag").withStack(10)
+	}
+	if m := header.Get("If-None-Match"); m != "" && etagMatch(m, etag, true) {
+		if r.AssertAction(ActionRead) {
+			return errorNotModified.withStack(10)
+		}
+		return errorPreconditionFailed.withStack(10)
+	}
+	return nil
+}
+
+// conditional checks if the request of an action called directly has If-Match or If-None-Match headers.
+func (r *Resource) conditional() bool {
+	if len(r.ActionsStack) > 1 || r.Access == nil || r.Access.Request == nil {
+		return false
+	}
+	header := r.Access.Request.Header
+	return header.Get("If-Match") != "" || header.Get("If-None-Match") != ""
+}
+
+// etagMatch checks the etag against a list of tags of an If-Match or If-None-Match header. If-None-Match uses the weak
+// comparison, so W/ tags match too, and If-Match the strong one (RFC 7232 2.3.2). An empty etag (no entity) matches
+// nothing, not even "*".
+func etagMatch(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotModified tells Respond to skip the body.
+func isNotModified(err error) bool {
+	e, ok := err.(complexError)
+	return ok && e.Code == http.StatusNotModified
+}
@@ -0,0 +1,132 @@
+package aeio
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestETagMatch(t *testing.T) {
+	etag := `"2-abc"`
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{"equal", `"2-abc"`, etag, false, true},
+		{"in list", `"1-abc", "2-abc"`, etag, false, true},
+		{"other", `"1-abc"`, etag, false, false},
+		{"any", `*`, etag, false, true},
+		{"weak tag on strong comparison", `W/"2-abc"`, etag, false, false},
+		{"weak tag on weak comparison", `W/"2-abc"`, etag, true, true},
+		{"weak list", `W/"1-abc", W/"2-abc"`, etag, true, true},
+		{"no entity", `*`, "", false, false},
+		{"no entity on weak comparison", `*`, "", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatch(tt.header, tt.etag, tt.weak); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETagPreconditions(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("")
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/rtcompany", `{"name":"acme"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %v", w.Code, res)
+	}
+	company, _ := res["key"].(string)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("create responded no ETag")
+	}
+
+	w, _ = routerTestServe(t, rt, http.MethodGet, company, "", nil)
+	if w.Header().Get("ETag") != etag {
+		t.Fatalf("get responded ETag %s, want %s", w.Header().Get("ETag"), etag)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		code   int
+	}{
+		{"get not modified", http.MethodGet, company, "", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"get not modified weak", http.MethodGet, company, "", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"get not modified any", http.MethodGet, company, "", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"get modified", http.MethodGet, company, "", map[string]string{"If-None-Match": `"0-0"`}, http.StatusOK},
+		{"update stale", http.MethodPatch, company, `{"name":"x"}`, map[string]string{"If-Match": `"0-0"`}, http.StatusPreconditionFailed},
+		{"update weak", http.MethodPatch, company, `{"name":"x"}`, map[string]string{"If-Match": "W/" + etag}, http.StatusPreconditionFailed},
+		{"update if none match", http.MethodPatch, company, `{"name":"x"}`, map[string]string{"If-None-Match": etag}, http.StatusPreconditionFailed},
+		{"put create only on existing", http.MethodPut, company, `{"name":"x"}`, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"put create only", http.MethodPut, "/rtcompany/77", `{"name":"new"}`, map[string]string{"If-None-Match": "*"}, http.StatusOK},
+		{"put on missing if match", http.MethodPut, "/rtcompany/78", `{"name":"new"}`, map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed},
+		{"delete stale", http.MethodDelete, company, "", map[string]string{"If-Match": `"0-0"`}, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, res := routerTestServe(t, rt, tt.method, tt.path, tt.body, tt.header)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, res)
+			}
+			if tt.code == http.StatusNotModified {
+				if w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+					t.Fatalf("304 with body %q and ETag %s", w.Body.String(), w.Header().Get("ETag"))
+				}
+			}
+		})
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodPatch, company, `{"name":"acme inc"}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK || routerTestData(res)["name"] != "acme inc" {
+		t.Fatalf("update: %d %v", w.Code, res)
+	}
+	updated := w.Header().Get("ETag")
+	if updated == "" || updated == etag {
+		t.Fatalf("update responded ETag %q, after %q", updated, etag)
+	}
+
+	w, _ = routerTestServe(t, rt, http.MethodDelete, company, "", map[string]string{"If-Match": etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("delete with the old ETag: %d", w.Code)
+	}
+	w, _ = routerTestServe(t, rt, http.MethodDelete, company, "", map[string]string{"If-Match": updated})
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+}
+
+func TestMarshalJSONMeta(t *testing.T) {
+	r := &Resource{Key: datastore.IDKey("rtcompany", 1, nil), Data: &routerTestCompany{Name: "acme"}}
+	j, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "updatedAt") || strings.Contains(string(j), "version") {
+		t.Fatalf("never saved resource has meta fields: %s", j)
+	}
+
+	r.touch()
+	j, err = json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"updatedAt"`) || !strings.Contains(string(j), `"version":1`) {
+		t.Fatalf("saved resource is missing meta fields: %s", j)
+	}
+}
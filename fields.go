@@ -0,0 +1,213 @@
+package aeio
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Field level visibility is declared on model fields with the aeio tag, using the same roles of permissions:
+//
+//	Total   int    `json:"total" aeio:"read=admin|owner,write=admin"`
+//	Secret  string `json:"secret" aeio:"read=admin,write=admin,reject"`
+//
+// Fields the caller can't read are stripped from responses, and filtering or sorting lists by them is a 403. Fields the
+// caller can't write are dropped from the request body on Create, Update and Put, or the request is rejected with 403
+// if the field has the reject flag. Put keeps the stored values of those fields when it replaces an entity.
+// Only top level fields (and the ones of embedded structs) are checked.
+
+// fieldRule holds the parsed aeio tag of a field.
+type fieldRule struct {
+	jsonName string
+	read     []string
+	write    []string
+	reject   bool
+}
+
+var fieldRulesCache sync.Map
+
+// fieldRules returns the rules of the struct fields that have an aeio tag.
+func fieldRules(t reflect.Type) []fieldRule {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if rules, ok := fieldRulesCache.Load(t); ok {
+		return rules.([]fieldRule)
+	}
+
+	var rules []fieldRule
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		jsonName := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if jsonName == "-" {
+			continue
+		}
+		if sf.Anonymous && jsonName == "" {
+			rules = append(rules, fieldRules(sf.Type)...)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("aeio")
+		if !ok {
+			continue
+		}
+		rule := fieldRule{jsonName: jsonName}
+		if rule.jsonName == "" {
+			rule.jsonName = sf.Name
+		}
+		for _, entry := range strings.Split(tag, ",") {
+			entry = strings.TrimSpace(entry)
+			switch {
+			case strings.HasPrefix(entry, "read="):
+				rule.read = strings.Split(strings.TrimPrefix(entry, "read="), "|")
+			case strings.HasPrefix(entry, "write="):
+				rule.write = strings.Split(strings.TrimPrefix(entry, "write="), "|")
+			case entry == "reject":
+				rule.reject = true
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	fieldRulesCache.Store(t, rules)
+	return rules
+}
+
+// readableData returns the data to be serialized, without the fields the caller can't read or didn't ask for.
+func (r *Resource) readableData() (interface{}, error) {
+	if r.Data == nil {
+		return nil, nil
+	}
+
+	var hidden []string
+	for _, rule := range fieldRules(reflect.TypeOf(r.Data)) {
+		if rule.read != nil && !r.HasAnyRole(rule.read...) {
+			hidden = append(hidden, rule.jsonName)
+		}
+	}
+	if len(hidden) == 0 && r.fields == nil {
+		return r.Data, nil
+	}
+
+	j, err := json.Marshal(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(j, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range hidden {
+		delete(fields, name)
+	}
+	for name := range fields {
+		if !r.respondsField(name) {
+			delete(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// unreadableProperties returns the set of properties of the fields of the model the caller can't read.
+func (r *Resource) unreadableProperties(model reflect.Type, fields map[string]queryField) map[string]bool {
+	if model == nil {
+		return nil
+	}
+	var hidden map[string]bool
+	for _, rule := range fieldRules(model) {
+		if rule.read == nil || r.HasAnyRole(rule.read...) {
+			continue
+		}
+		if field, ok := fields[rule.jsonName]; ok {
+			if hidden == nil {
+				hidden = make(map[string]bool)
+			}
+			hidden[field.property] = true
+		}
+	}
+	return hidden
+}
+
+// writableBody drops from the json object body the fields the caller can't write, or fails if any of them is
+// flagged to reject. Bodies that are not json objects are returned untouched.
+func (r *Resource) writableBody(body []byte) ([]byte, error) {
+	denied := r.unwritableFields()
+	if len(denied) == 0 {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body, nil
+	}
+
+	dropped := false
+	for name := range fields {
+		for _, rule := range denied {
+			// json binds keys case insensitively, so must we
+			if !strings.EqualFold(name, rule.jsonName) {
+				continue
+			}
+			if rule.reject {
+				err := fmt.Errorf("field %s is not writable by the caller", rule.jsonName)
+				return nil, errorForbidden.withCause(err).withStack(10)
+			}
+			delete(fields, name)
+			dropped = true
+		}
+	}
+	if !dropped {
+		return body, nil
+	}
+	return json.Marshal(fields)
+}
+
+// unwritableFields returns the rules of the fields of the data the caller can't write.
+func (r *Resource) unwritableFields() []fieldRule {
+	var denied []fieldRule
+	for _, rule := range fieldRules(reflect.TypeOf(r.Data)) {
+		if rule.write != nil && !r.HasAnyRole(rule.write...) {
+			denied = append(denied, rule)
+		}
+	}
+	return denied
+}
+
+// keepUnwritable copies into the data the fields of the stored data that the caller can't write, so replacing the
+// entity doesn't reset them.
+func (r *Resource) keepUnwritable(stored interface{}) error {
+	denied := r.unwritableFields()
+	if len(denied) == 0 {
+		return nil
+	}
+
+	j, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(j, &fields)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]json.RawMessage, len(denied))
+	for _, rule := range denied {
+		if v, ok := fields[rule.jsonName]; ok {
+			kept[rule.jsonName] = v
+		}
+	}
+	j, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, &r.Data)
+}
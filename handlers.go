@@ -1,7 +1,22 @@
 package aeio
 
+import "strconv"
+
 type Handler func(*Resource) error
 
+// Middleware wraps a Handler, running code before and after it, or even not calling it at all.
+// Use it for auth, logging, rate limiting, metrics and anything common to many handlers.
+// Values stashed with Resource.Set are seen by the hooks of the resource and of the resources sharing its Access.
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the outermost, so it runs first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
 func HandleCreate(r *Resource) error {
 	return r.Create()
 }
@@ -10,6 +25,28 @@ func HandleUpdate(r *Resource) error {
 	return r.Update()
 }
 
+func HandlePut(r *Resource) error {
+	return r.Put()
+}
+
+// HandleAllocate reserves the number of ids asked by the allocate query parameter, one by default.
+func HandleAllocate(r *Resource) error {
+	n, _ := strconv.Atoi(r.Access.Request.URL.Query().Get("allocate"))
+	return r.Allocate(n)
+}
+
+func HandleCreateMany(r *Resource) error {
+	return r.CreateMany()
+}
+
+func HandleUpdateMany(r *Resource) error {
+	return r.UpdateMany()
+}
+
+func HandleDeleteMany(r *Resource) error {
+	return r.DeleteMany()
+}
+
 func HandleGet(r *Resource) error {
 	return r.Get()
 }
@@ -25,3 +62,18 @@ func HandleGetAny(r *Resource) error {
 func HandleDelete(r *Resource) error {
 	return r.Delete()
 }
+
+// actionHandlers are the handlers used by the Router for each action, unless overridden for a kind.
+var actionHandlers = map[string]Handler{
+	ActionCreate:   HandleCreate,
+	ActionRead:     HandleGet,
+	ActionReadMany: HandleGetList,
+	ActionUpdate:   HandleUpdate,
+	ActionPut:      HandlePut,
+	ActionAllocate: HandleAllocate,
+
+	ActionCreateMany: HandleCreateMany,
+	ActionUpdateMany: HandleUpdateMany,
+	ActionDeleteMany: HandleDeleteMany,
+	ActionDelete:     HandleDelete,
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -185,11 +186,21 @@ func parseInt(v string) (i int) {
 // 	return reg.ReplaceAllString(s, "")
 // }
 
-// NewResourceFromRequest initializes a base resource with information from the request.
+// NewResourceFromRequest initializes a base resource with information from the request, bound to the default App.
 func NewResourceFromRequest(writer *http.ResponseWriter, request *http.Request) (*Resource, error) {
+	return Default().NewResourceFromRequest(writer, request)
+}
+
+// NewResourceFromRequest initializes a base resource with information from the request, bound to the App.
+func (app *App) NewResourceFromRequest(writer *http.ResponseWriter, request *http.Request) (*Resource, error) {
+	return app.newResourceFromPath(writer, request, request.URL.EscapedPath())
+}
+
+// newResourceFromPath is like NewResourceFromRequest, but takes the resource path apart from the request url.
+func (app *App) newResourceFromPath(writer *http.ResponseWriter, request *http.Request, path string) (*Resource, error) {
 	r := &Resource{}
-	r.Access = newAccess(writer, request)
-	r.Key = Key(r.Access.Request.URL.Path)
+	r.Access = newAccess(app, writer, request)
+	r.Key = app.Registry.Key(path)
 	if r.Key == nil {
 		return r, errorInvalidPath.withStack(10)
 	}
@@ -213,31 +224,37 @@ func NewResource(access *Access, parentKey *datastore.Key, kind string) (*Resour
 		parentKey = datastore.IncompleteKey("", nil)
 	}
 
-	err := ValidatePaternity(parentKey.Kind, kind)
+	registry := accessApp(access).Registry
+	err := registry.ValidatePaternity(parentKey.Kind, kind)
 	if err != nil {
 		return nil, err
 	}
 
 	if parentKey.Kind == "" {
-		r.Key = Key("/" + kind)
+		r.Key = registry.Key("/" + kind)
 	} else {
-		r.Key = Key(Path(parentKey) + "/" + kind)
+		r.Key = registry.Key(Path(parentKey) + "/" + kind)
 	}
 
 	if r.Key == nil {
 		return nil, errorInvalidPath.withStack(10)
 	}
-	r.Data, err = NewObject(kind)
+	r.Data, err = registry.NewObject(kind)
 	if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-// Key transforms a path in a datastore key using an access.
+// Key transforms a path in a datastore key, using the kinds key types of the DefaultRegistry.
 func Key(path string) (k *datastore.Key) {
+	return DefaultRegistry.Key(path)
+}
+
+// Key transforms a path in a datastore key. Segments of kinds registered with KeyTypeName are unescaped names,
+// the others must be positive numeric ids. Invalid paths return nil.
+func (reg *Registry) Key(path string) (k *datastore.Key) {
 	var kd string
-	var id int64
 	var p []string
 
 	if path == "" {
@@ -256,7 +273,25 @@ func Key(path string) (k *datastore.Key) {
 	for i := 0; i < len(p); i = i + 2 {
 		kd = p[i]
 		if i < len(p)-1 {
-			id, _ = strconv.ParseInt(p[i+1], 10, 64)
+			segment, err := url.PathUnescape(p[i+1])
+			if err != nil || segment == "" {
+				log.Println("invalid_path_segment", path, p[i+1])
+				return nil
+			}
+			if reg.KeyType(kd) == KeyTypeName {
+				// datastore reserves names like __name__
+				if strings.HasPrefix(segment, "__") && strings.HasSuffix(segment, "__") {
+					log.Println("reserved_name_path_segment", path, segment)
+					return nil
+				}
+				k = datastore.NameKey(kd, segment, k)
+				continue
+			}
+			id, err := strconv.ParseInt(segment, 10, 64)
+			if err != nil || id <= 0 {
+				log.Println("invalid_id_path_segment", path, segment)
+				return nil
+			}
 			k = datastore.IDKey(kd, id, k)
 		} else {
 			k = datastore.IncompleteKey(kd, k)
@@ -265,10 +300,13 @@ func Key(path string) (k *datastore.Key) {
 	return k
 }
 
-// Path transforms a datastore Key into a Path
+// Path transforms a datastore Key into a Path. Names are escaped, so they round trip with Key. A nil key is an empty path.
 func Path(k *datastore.Key) (p string) {
+	if k == nil {
+		return ""
+	}
 	if k.Incomplete() == false {
-		p = "/" + strconv.FormatInt(k.ID, 10)
+		p = "/" + pathSegment(k)
 	}
 	p = "/" + k.Kind + p
 	for {
@@ -276,15 +314,30 @@ func Path(k *datastore.Key) (p string) {
 		if k == nil {
 			break
 		}
-		p = "/" + k.Kind + "/" + strconv.FormatInt(k.ID, 10) + p
+		p = "/" + k.Kind + "/" + pathSegment(k) + p
 	}
 	return p
 }
 
+// pathSegment is the escaped name or the id of a complete key.
+func pathSegment(k *datastore.Key) string {
+	if k.Name != "" {
+		return url.PathEscape(k.Name)
+	}
+	return strconv.FormatInt(k.ID, 10)
+}
+
+// CheckAdminToken verifies the Firebase ID token of the request and checks that it has the admin role.
+// Prefer an Authenticator and Principal.HasRole, that are not bound to Firebase.
+// It uses the auth client of the default App, and fails if it has firebase disabled.
 func CheckAdminToken(request *http.Request) error {
-	jwtToken := request.Header.Get("Authorization")
+	jwtToken := BearerToken(request)
 
-	token, err := FireAppAuthClient.VerifyIDToken(request.Context(), jwtToken)
+	client := Default().FireAppAuthClient
+	if client == nil {
+		return errors.New("firebase_disabled")
+	}
+	token, err := client.VerifyIDToken(request.Context(), jwtToken)
 	if err != nil {
 		log.Println("error verifying token")
 		return err
@@ -0,0 +1,174 @@
+package aeio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Index is a datastore composite index, as declared in index.yaml.
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []IndexProperty
+}
+
+// IndexProperty is a property of an Index, ascending unless Desc.
+type IndexProperty struct {
+	Name string
+	Desc bool
+}
+
+// String formats the index as an entry of index.yaml.
+func (idx Index) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "- kind: %s\n", idx.Kind)
+	if idx.Ancestor {
+		b.WriteString("  ancestor: yes\n")
+	}
+	b.WriteString("  properties:\n")
+	for _, p := range idx.Properties {
+		fmt.Fprintf(&b, "  - name: %s\n", p.Name)
+		if p.Desc {
+			b.WriteString("    direction: desc\n")
+		}
+	}
+	return b.String()
+}
+
+// WriteIndexYAML writes the index.yaml of the DefaultRegistry. See Registry.WriteIndexYAML.
+func WriteIndexYAML(w io.Writer) error {
+	return DefaultRegistry.WriteIndexYAML(w)
+}
+
+// WriteIndexYAML writes an index.yaml with the Indexes of the registry, to deploy with
+// "gcloud datastore indexes create index.yaml".
+func (reg *Registry) WriteIndexYAML(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("# Generated by aeio from the list fields of the models.\nindexes:\n")
+	for _, idx := range reg.Indexes() {
+		_, _ = bw.WriteString("\n" + idx.String())
+	}
+	return bw.Flush()
+}
+
+// Indexes returns the composite indexes needed by the lists of the kinds registered with RegisterListFields: each
+// sortable field in both directions and the default sort, alone or after an equality filter on a filterable field,
+// and each filterable field with an inequality filter. Lists under a parent always filter on Parent, and kinds
+// registered with RegisterStrongLists are listed with ancestor queries, so their indexes include them. Lists combining
+// more filters and sorts, or asking another consistency with X-Consistency, need indexes declared by hand, and kinds
+// without list fields take any field, so they have no indexes generated.
+func (reg *Registry) Indexes() []Index {
+	var indexes []Index
+	seen := make(map[string]bool)
+	add := func(idx Index) {
+		// a single property without ancestor is served by the built-in indexes
+		if len(idx.Properties) < 2 && !idx.Ancestor {
+			return
+		}
+		s := idx.String()
+		if !seen[s] {
+			seen[s] = true
+			indexes = append(indexes, idx)
+		}
+	}
+
+	kinds := make([]string, 0, len(reg.listFields))
+	for kind := range reg.listFields {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		declared := reg.listFields[kind]
+		fields := queryFields(reflect.TypeOf(reg.models[kind]))
+		property := func(name string) IndexProperty {
+			return IndexProperty{Name: fields[strings.TrimPrefix(name, "-")].property, Desc: strings.HasPrefix(name, "-")}
+		}
+
+		var sorts [][]IndexProperty
+		for _, name := range declared.Sortable {
+			sorts = append(sorts, []IndexProperty{property(name)}, []IndexProperty{property("-" + name)})
+		}
+		if len(declared.DefaultSort) > 0 {
+			var defaultSort []IndexProperty
+			for _, name := range declared.DefaultSort {
+				defaultSort = append(defaultSort, property(name))
+			}
+			sorts = append(sorts, defaultSort)
+		}
+
+		for _, parent := range reg.parents(kind) {
+			var prefix []IndexProperty
+			ancestor := false
+			if parent != "" {
+				prefix = []IndexProperty{{Name: "Parent"}}
+				ancestor = reg.StrongLists(kind)
+			}
+			index := func(props ...IndexProperty) Index {
+				return Index{Kind: kind, Ancestor: ancestor, Properties: append(append([]IndexProperty(nil), prefix...), props...)}
+			}
+
+			for _, s := range sorts {
+				add(index(s...))
+				for _, name := range declared.Filterable {
+					f := property(name)
+					if f.Name != s[0].Name {
+						add(index(append([]IndexProperty{f}, s...)...))
+					}
+				}
+			}
+			for _, name := range declared.Filterable {
+				add(index(property(name)))
+			}
+		}
+	}
+	return indexes
+}
+
+// parents returns the kinds the kind is a child of, with "" for the root.
+func (reg *Registry) parents(kind string) []string {
+	var parents []string
+	for parent, children := range reg.children {
+		if _, ok := children[kind]; ok {
+			parents = append(parents, parent)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// queryIndex is the composite index datastore needs to run the query: equality filters, then the inequality
+// filter, then the orders. Filters applied out of datastore are left out.
+func queryIndex(q *Query) Index {
+	idx := Index{Kind: q.Kind, Ancestor: q.AncestorKey != nil}
+	inequality := ""
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "=":
+			idx.Properties = append(idx.Properties, IndexProperty{Name: f.Field})
+		case "<", "<=", ">", ">=":
+			inequality = f.Field
+		}
+	}
+	if inequality != "" && (len(q.Orders) == 0 || q.Orders[0].Field != inequality) {
+		idx.Properties = append(idx.Properties, IndexProperty{Name: inequality})
+	}
+	for _, o := range q.Orders {
+		idx.Properties = append(idx.Properties, IndexProperty{Name: o.Field, Desc: o.Desc})
+	}
+	return idx
+}
+
+// isMissingIndex tells if the datastore error is of a query without its composite index.
+func isMissingIndex(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no matching index found")
+}
+
+// missingIndexError names the index the query needs.
+func missingIndexError(q *Query, err error) error {
+	return errorDatastoreMissingIndex.withHint("Add this index to index.yaml and deploy it, or declare the list fields so WriteIndexYAML generates it:\n" + queryIndex(q).String()).withCause(err).withStack(10)
+}
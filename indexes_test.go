@@ -0,0 +1,91 @@
+package aeio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexesTestIndex makes an index of the properties, descending if prefixed with "-".
+func indexesTestIndex(kind string, ancestor bool, properties ...string) Index {
+	idx := Index{Kind: kind, Ancestor: ancestor}
+	for _, name := range properties {
+		idx.Properties = append(idx.Properties, IndexProperty{Name: strings.TrimPrefix(name, "-"), Desc: strings.HasPrefix(name, "-")})
+	}
+	return idx
+}
+
+func indexesTestRegistry() *Registry {
+	reg := NewRegistry()
+	reg.RegisterModel("ixcompany", routerTestCompany{})
+	reg.RegisterModel("ixinvoice", routerTestInvoice{})
+	reg.RegisterModel("ixroot", routerTestInvoice{})
+	reg.RegisterChild("", "ixcompany")
+	reg.RegisterChild("ixcompany", "ixinvoice")
+	reg.RegisterChild("", "ixroot")
+	reg.RegisterStrongLists("ixinvoice")
+	reg.RegisterListFields("ixinvoice", ListFields{Filterable: []string{"status"}, Sortable: []string{"total"}, DefaultSort: []string{"-createdAt"}})
+	reg.RegisterListFields("ixroot", ListFields{Filterable: []string{"status", "total"}, Sortable: []string{"total"}})
+	return reg
+}
+
+func TestRegistryIndexes(t *testing.T) {
+	want := []Index{
+		// under a parent with strong lists, every index has the ancestor and Parent
+		indexesTestIndex("ixinvoice", true, "Parent", "Total"),
+		indexesTestIndex("ixinvoice", true, "Parent", "Status", "Total"),
+		indexesTestIndex("ixinvoice", true, "Parent", "-Total"),
+		indexesTestIndex("ixinvoice", true, "Parent", "Status", "-Total"),
+		indexesTestIndex("ixinvoice", true, "Parent", "-CreatedAt"),
+		indexesTestIndex("ixinvoice", true, "Parent", "Status", "-CreatedAt"),
+		indexesTestIndex("ixinvoice", true, "Parent", "Status"),
+
+		// at the root, single properties are built-in, and a field is not filtered before its own sort
+		indexesTestIndex("ixroot", false, "Status", "Total"),
+		indexesTestIndex("ixroot", false, "Status", "-Total"),
+	}
+
+	got := indexesTestRegistry().Indexes()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got indexes\n%v\nwant\n%v", got, want)
+	}
+
+	if indexes := NewRegistry().Indexes(); len(indexes) != 0 {
+		t.Fatalf("registry without list fields has indexes %v", indexes)
+	}
+}
+
+func TestWriteIndexYAML(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterModel("ixroot", routerTestInvoice{})
+	reg.RegisterChild("", "ixroot")
+	reg.RegisterListFields("ixroot", ListFields{Filterable: []string{"status", "total"}, Sortable: []string{"total"}})
+
+	var b strings.Builder
+	err := reg.WriteIndexYAML(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Generated by aeio from the list fields of the models.
+indexes:
+
+- kind: ixroot
+  properties:
+  - name: Status
+  - name: Total
+
+- kind: ixroot
+  properties:
+  - name: Status
+  - name: Total
+    direction: desc
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	idx := indexesTestIndex("ixinvoice", true, "Parent", "-CreatedAt")
+	if s := idx.String(); !strings.Contains(s, "  ancestor: yes\n") || !strings.HasSuffix(s, "  - name: CreatedAt\n    direction: desc\n") {
+		t.Fatalf("ancestor index formatted as\n%s", s)
+	}
+}
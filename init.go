@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"sync"
 
 	"cloud.google.com/go/datastore"
 	firebase "firebase.google.com/go/v4"
@@ -30,56 +31,109 @@ var ContextCancel context.CancelFunc
 
 // DatastoreClient is the global default singleton datastore client. Use it everytime that you need to access the datastore by yourself.
 // It uses the main context, so it will respect the the context cancellation.
+// It is set when the default App is initialized, so it is nil before the first call to Default, and also when the
+// default App has an injected store. Older versions set it on package initialization, so code reading it directly
+// must call Default first, or use GetDatastoreClient, which does.
 var DatastoreClient *datastore.Client
 
 // FireApp it the default Firebase App. You may use it to access different services of firebase.
 // We already provide a client for Authentication: the FireAppAuthClient
+// Like DatastoreClient, it is nil before the first call to Default, or if firebase is disabled. See GetFireApp.
 var FireApp *firebase.App
 
-// FireAppAuthClient is the Firebase Auth Client.
+// FireAppAuthClient is the Firebase Auth Client. Nil before the first call to Default, or if firebase is disabled.
+// See GetFireAppAuthClient.
 var FireAppAuthClient *firebaseAuth.Client
 
+// GetDatastoreClient returns the DatastoreClient, initializing the default App if needed.
+func GetDatastoreClient() *datastore.Client {
+	return Default().DatastoreClient
+}
+
+// GetFireApp returns the FireApp, initializing the default App if needed.
+func GetFireApp() *firebase.App {
+	return Default().FireApp
+}
+
+// GetFireAppAuthClient returns the FireAppAuthClient, initializing the default App if needed.
+func GetFireAppAuthClient() *firebaseAuth.Client {
+	return Default().FireAppAuthClient
+}
+
+// DisableFirebase makes Default skip the firebase app and auth client, as needed to run without credentials.
+// It is implied when DefaultStore is set.
+var DisableFirebase = false
+
+// DefaultApp is the instance used by package level functions and by resources not created from an App.
+// It is kept for backwards compatibility with the globals above; prefer building your own with New.
+var DefaultApp *App
+
+var defaultAppOnce sync.Once
+
 // On localhost with emulators, set these ENV before running the application
 // DATASTORE_EMULATOR_HOST=localhost:8081;ENVIRONMENT=DEVELOPMENT;GOOGLE_APPLICATION_CREDENTIALS=../gaeio2-firebase-adminsdk-82w3s-69fc074ae2.json
 
 func init() {
-	var err error
-
 	if os.Getenv("DEVELOPMENT") == "true" {
 		Development = true
 		log.Println("Initializing App as DEVELOPMENT")
 	}
 
 	Context, ContextCancel = context.WithCancel(context.Background())
-	DatastoreClient, err = datastore.NewClient(Context, datastore.DetectProjectID)
-	if err != nil {
-		log.Fatalf("error initializing datastore client: %v", err)
-	}
+}
 
-	FireApp, err = firebase.NewApp(Context, nil)
-	if err != nil {
-		log.Fatalf("error initializing firebase app: %v", err)
-	}
+// Default returns the default App, connecting it on the first call with the package globals as configuration.
+// Like the package initialization of older versions, it exits the process if the connection fails. To handle the error,
+// build the App with New and install it with SetDefault before any use.
+// If DefaultStore is set before the first call, it is used instead of connecting to datastore, and firebase is not
+// initialized either, so tests with a MemoryStore run without credentials.
+func Default() *App {
+	defaultAppOnce.Do(func() {
+		if DefaultApp != nil {
+			return
+		}
+		app, err := New(Config{
+			Context:          Context,
+			Store:            DefaultStore,
+			Development:      Development,
+			QuerySizeDefault: QuerySizeDefault,
+			QuerySizeMax:     QuerySizeMax,
+			ServerHost:       ServerHost,
+			ServerPort:       ServerPort,
+			DisableFirebase:  DisableFirebase || DefaultStore != nil,
+		})
+		if err != nil {
+			log.Fatalf("error initializing default app: %v", err)
+		}
+		SetDefault(app)
+	})
+	return DefaultApp
+}
 
-	FireAppAuthClient, err = FireApp.Auth(Context)
-	if err != nil {
-		log.Fatalf("error initializing firebase auth client: %v", err)
-	}
+// SetDefault installs the app as the default instance and updates the package globals to its clients.
+func SetDefault(app *App) {
+	DefaultApp = app
+	DatastoreClient = app.DatastoreClient
+	FireApp = app.FireApp
+	FireAppAuthClient = app.FireAppAuthClient
+	DefaultStore = app.Store
 }
 
 // ShutdownApplication should be called anytime the app exits to close services connections.
 // Recommended to be put as a deferred call on the start of the main application.
+// Serve already does it after draining the requests, so this is only needed when exiting by other means.
 // ie.:
 // `func main() {
 //	  defer aeio.ShutdownApplication()
 //    ... middleware and routes ...
 // 	  err = aeio.Serve(router)
-//	  log.Fatal(err)
+//	  if err != nil {
+//	    log.Fatal(err)
+//	  }
 // }
 func ShutdownApplication() {
-	err := DatastoreClient.Close()
-	if err != nil {
-		log.Print("error_closing_datastore_client:", err)
+	if DefaultApp != nil {
+		DefaultApp.Close()
 	}
 
 	ContextCancel()
@@ -0,0 +1,79 @@
+package aeio
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KindsPath is the path, after the router prefix, that describes the registered kinds, so clients know how to list
+// them. Kinds the caller can't list are left out.
+const KindsPath = "/_kinds"
+
+// KindInfo describes a registered kind. List is nil when the kind takes any field in filters and sorts.
+type KindInfo struct {
+	Kind     string      `json:"kind"`
+	KeyType  string      `json:"keyType"`
+	Parents  []string    `json:"parents"`
+	Children []string    `json:"children,omitempty"`
+	List     *ListFields `json:"list"`
+}
+
+// KindsResponse is the body responded to KindsPath.
+type KindsResponse struct {
+	Kinds       []*KindInfo `json:"kinds"`
+	TimeElapsed int64       `json:"timeElapsed,omitempty"`
+}
+
+// Kinds describes the registered kinds, sorted by name. Root kinds have "" in Parents.
+func (reg *Registry) Kinds() []*KindInfo {
+	kinds := make([]*KindInfo, 0, len(reg.models))
+	for kind := range reg.models {
+		info := &KindInfo{Kind: kind, KeyType: reg.KeyType(kind), Parents: append([]string{}, reg.parents(kind)...)}
+		for child := range reg.children[kind] {
+			info.Children = append(info.Children, child)
+		}
+		sort.Strings(info.Children)
+		if fields, ok := reg.ListFields(kind); ok {
+			info.List = &fields
+		}
+		kinds = append(kinds, info)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Kind < kinds[j].Kind })
+	return kinds
+}
+
+// serveKinds responds the kinds the caller has permission to list.
+func (rt *Router) serveKinds(r *Resource, start time.Time) error {
+	app, writer, request := r.App(), r.Access.Writer, r.Access.Request
+	if request.Method != http.MethodGet {
+		return errorMethodNotAllowed.withHint("Kinds are read with GET").withStack(10)
+	}
+
+	response := &KindsResponse{Kinds: make([]*KindInfo, 0)}
+	for _, info := range app.Registry.Kinds() {
+		r.Key = datastore.IncompleteKey(info.Kind, nil)
+		if r.Authorize(ActionReadMany) == nil {
+			response.Kinds = append(response.Kinds, info)
+		}
+	}
+	response.TimeElapsed = int64(time.Since(start) / time.Millisecond)
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	log.Printf("%d %s %s", http.StatusOK, request.Method, request.URL.Path)
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		_ = errorResponseMarshal.withCause(err).withStack(10).withLog()
+	}
+	_, err = writer.Write(j)
+	if err != nil {
+		_ = errorResponseWrite.withCause(err).withStack(10).withLog()
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package aeio
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestKindsRequest(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("/api")
+	calls := 0
+	rt.Use(func(next Handler) Handler {
+		return func(r *Resource) error {
+			calls++
+			if r.Access.Request.Header.Get("X-Tenant") == "" {
+				return errorForbidden.withCause(errors.New("no tenant")).withStack(10)
+			}
+			return next(r)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		code   int
+	}{
+		{"middleware rejects", http.MethodGet, nil, http.StatusForbidden},
+		{"get", http.MethodGet, map[string]string{"X-Tenant": "t"}, http.StatusOK},
+		{"post", http.MethodPost, map[string]string{"X-Tenant": "t"}, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			w, res := routerTestServe(t, rt, tt.method, "/api/_kinds", "", tt.header)
+			if w.Code != tt.code || calls != 1 {
+				t.Fatalf("got %d with %d middleware calls, want %d with 1: %v", w.Code, calls, tt.code, res)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			kinds, _ := res["kinds"].([]interface{})
+			if len(kinds) != 2 || kinds[0].(map[string]interface{})["kind"] != "rtcompany" || kinds[1].(map[string]interface{})["kind"] != "rtinvoice" {
+				t.Fatalf("got kinds %v", res["kinds"])
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package aeio
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Lists are filtered and sorted with the filter and sort query string parameters, repeated as needed:
+//
+//	GET /company/1/invoice?filter=status:eq:open&filter=total:gte:100&sort=-createdAt
+//
+// Filters are field:operator:value, where the operator is one of eq, ne, lt, lte, gt, gte, in or nin (not in), and
+// the values of in and nin are separated by commas. Sorts are fields, descending if prefixed with "-", and may also be
+// separated by commas. Fields are the json names of the model fields, or createdAt, updatedAt and version, and values
+// are converted to the type of the field. Unknown fields and values that don't convert are a 400. Datastore doesn't
+// filter with ne, in and nin, so they are applied to the rows read, and lists reading more than DatastoreStore.ScanMax
+// rows for them are a 400 too.
+//
+// The X-Filters and X-Sorters headers still work with datastore property names, like before. Kinds registered with
+// RegisterListFields only take the declared fields, in the parameters and in the headers.
+const (
+	paramFilter = "filter"
+	paramSort   = "sort"
+)
+
+var filterOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "!=",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+	"in":  "in",
+	"nin": "not-in",
+}
+
+// queryField is a field of a model that can be filtered and sorted.
+type queryField struct {
+	property string
+	jsonName string
+	typ      reflect.Type
+	noindex  bool
+}
+
+var queryFieldsCache sync.Map
+
+// queryFields maps the json names and the property names of the saved fields of the model type to their property and
+// type, including the ones the Resource adds. Only top level fields (and the ones of embedded structs) are mapped.
+func queryFields(t reflect.Type) map[string]queryField {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	if fields, ok := queryFieldsCache.Load(t); ok {
+		return fields.(map[string]queryField)
+	}
+
+	fields := map[string]queryField{
+		"createdAt": {property: "CreatedAt", jsonName: "createdAt", typ: reflect.TypeOf(time.Time{})},
+		"updatedAt": {property: propertyUpdatedAt, jsonName: "updatedAt", typ: reflect.TypeOf(time.Time{})},
+		"version":   {property: propertyVersion, jsonName: "version", typ: reflect.TypeOf(int64(0))},
+	}
+	for _, meta := range []string{"createdAt", "updatedAt", "version"} {
+		fields[fields[meta].property] = fields[meta]
+	}
+	addQueryFields(t, fields)
+
+	queryFieldsCache.Store(t, fields)
+	return fields
+}
+
+func addQueryFields(t reflect.Type, fields map[string]queryField) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := strings.Split(sf.Tag.Get("datastore"), ",")
+		property := tag[0]
+		if property == "-" {
+			continue
+		}
+		if sf.Anonymous && property == "" && sf.Type.Kind() == reflect.Struct {
+			addQueryFields(sf.Type, fields)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if property == "" {
+			property = sf.Name
+		}
+		field := queryField{property: property, jsonName: sf.Name, typ: sf.Type}
+		for _, option := range tag[1:] {
+			if option == "noindex" {
+				field.noindex = true
+			}
+		}
+		switch jsonName := strings.Split(sf.Tag.Get("json"), ",")[0]; jsonName {
+		case "-":
+			field.jsonName = ""
+		case "":
+		default:
+			field.jsonName = jsonName
+		}
+		fields[property] = field
+		if field.jsonName != "" {
+			fields[field.jsonName] = field
+		}
+	}
+}
+
+// applyListParams adds the filters and sorts of the request to the list query.
+func (r *Resource) applyListParams(q *Query) (*Query, error) {
+	params := r.Access.Request.URL.Query()
+	filters := params[paramFilter]
+	sorts := params[paramSort]
+	header := r.Access.Request.Header
+
+	declared, restricted := r.App().Registry.ListFields(r.Key.Kind)
+	model := reflect.TypeOf(r.App().Registry.models[r.Key.Kind])
+	fields := queryFields(model)
+	filtersBefore, ordersBefore := len(q.Filters), len(q.Orders)
+
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, ":", 3)
+		if len(parts) != 3 {
+			return nil, errorInvalidListQuery.withHint("Filters are field:operator:value, like status:eq:open").withCause(fmt.Errorf("malformed filter %s", filter)).withStack(10)
+		}
+		field, ok := fields[parts[0]]
+		if !ok {
+			return nil, errorInvalidListQuery.withHint("Filter by the fields of " + r.Key.Kind).withCause(fmt.Errorf("unknown field %s", parts[0])).withStack(10)
+		}
+		op, ok := filterOperators[parts[1]]
+		if !ok {
+			return nil, errorInvalidListQuery.withHint("Use one of eq, ne, lt, lte, gt, gte, in or nin").withCause(fmt.Errorf("unknown operator %s", parts[1])).withStack(10)
+		}
+
+		var value interface{}
+		var err error
+		if op == "in" || op == "not-in" {
+			values := make([]interface{}, 0)
+			for _, raw := range strings.Split(parts[2], ",") {
+				v, err := filterValue(r.App().Registry, raw, field.typ)
+				if err != nil {
+					return nil, errorInvalidListQuery.withHint(fmt.Sprintf("Values of %s must be of type %s", parts[0], field.typ)).withCause(err).withStack(10)
+				}
+				values = append(values, v)
+			}
+			value = values
+		} else {
+			value, err = filterValue(r.App().Registry, parts[2], field.typ)
+			if err != nil {
+				return nil, errorInvalidListQuery.withHint(fmt.Sprintf("Values of %s must be of type %s", parts[0], field.typ)).withCause(err).withStack(10)
+			}
+		}
+		q = q.Filter(field.property+" "+op, value)
+	}
+
+	for _, sort := range sorts {
+		for _, name := range strings.Split(sort, ",") {
+			desc := strings.HasPrefix(name, "-")
+			field, ok := fields[strings.TrimPrefix(name, "-")]
+			if !ok {
+				return nil, errorInvalidListQuery.withHint("Sort by the fields of " + r.Key.Kind).withCause(fmt.Errorf("unknown field %s", name)).withStack(10)
+			}
+			if desc {
+				q = q.Order("-" + field.property)
+			} else {
+				q = q.Order(field.property)
+			}
+		}
+	}
+
+	// query sorters fields separated by comma
+	if sorters := header.Get(headerSorters); sorters != "" {
+		for _, v := range strings.Split(sorters, ",") {
+			q = q.Order(v)
+		}
+	}
+
+	// one of ">", "<", ">=", "<=", or "="
+	// filters = [{"Field": "fieldString =", "Value": "word"}, {"Field": "fieldInt >", "Value": 1}]
+	if fs := header.Get(headerFilters); fs != "" {
+		var headerFilters []struct {
+			Field string
+			Value interface{}
+		}
+		err := json.Unmarshal([]byte(fs), &headerFilters)
+		if err != nil {
+			return nil, errorInvalidListQuery.withHint("X-Filters is a json array of {\"Field\": \"Name op\", \"Value\": value}").withCause(err).withStack(10)
+		}
+		for _, v := range headerFilters {
+			q = q.Filter(v.Field, v.Value)
+		}
+	}
+
+	if q.Err() != nil {
+		return nil, errorInvalidListQuery.withCause(q.Err()).withStack(10)
+	}
+
+	// filters and sorts on fields the caller can't read would tell their values
+	if hidden := r.unreadableProperties(model, fields); len(hidden) > 0 {
+		for _, f := range q.Filters[filtersBefore:] {
+			if hidden[f.Field] {
+				return nil, errorForbidden.withCause(fmt.Errorf("field %s is not readable by the caller", f.Field)).withStack(10)
+			}
+		}
+		for _, o := range q.Orders[ordersBefore:] {
+			if hidden[o.Field] {
+				return nil, errorForbidden.withCause(fmt.Errorf("field %s is not readable by the caller", o.Field)).withStack(10)
+			}
+		}
+	}
+
+	if restricted {
+		return checkListFields(q, declared, fields, filtersBefore, ordersBefore)
+	}
+	return q, nil
+}
+
+// scanLimitError describes the lists whose filters read too many rows, see ErrScanLimit.
+func scanLimitError(err error) error {
+	return errorInvalidListQuery.withHint("The ne, in and nin filters read too many rows, narrow the list with eq or range filters").withCause(err).withStack(10)
+}
+
+// checkListFields checks the filters and orders added to the query by the request against the declared list fields,
+// and adds the default sort if the request has none.
+func checkListFields(q *Query, declared ListFields, fields map[string]queryField, filtersBefore int, ordersBefore int) (*Query, error) {
+	filterable := listProperties(declared.Filterable, fields)
+	for _, f := range q.Filters[filtersBefore:] {
+		if !filterable[f.Field] {
+			return nil, errorInvalidListQuery.withHint(fmt.Sprintf("Filter by one of %v", declared.Filterable)).withCause(fmt.Errorf("field %s is not filterable", f.Field)).withStack(10)
+		}
+	}
+
+	sortable := listProperties(declared.Sortable, fields)
+	for _, o := range q.Orders[ordersBefore:] {
+		if !sortable[o.Field] {
+			return nil, errorInvalidListQuery.withHint(fmt.Sprintf("Sort by one of %v", declared.Sortable)).withCause(fmt.Errorf("field %s is not sortable", o.Field)).withStack(10)
+		}
+	}
+
+	if len(q.Orders) == ordersBefore {
+		for _, name := range declared.DefaultSort {
+			if strings.HasPrefix(name, "-") {
+				q = q.Order("-" + fields[name[1:]].property)
+			} else {
+				q = q.Order(fields[name].property)
+			}
+		}
+	}
+	return q, nil
+}
+
+// listProperties returns the set of properties of the named fields.
+func listProperties(names []string, fields map[string]queryField) map[string]bool {
+	properties := make(map[string]bool, len(names))
+	for _, name := range names {
+		if field, ok := fields[name]; ok {
+			properties[field.property] = true
+		}
+	}
+	return properties
+}
+
+// filterValue converts a query string value to the type of a field, or of its items if it is a slice, as stored in
+// datastore. Key paths are parsed with the kinds of the registry. As the query string is already unescaped, the names
+// in them are taken as they are, so they can't have slashes.
+func filterValue(reg *Registry, raw string, t reflect.Type) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return time.Parse(time.RFC3339Nano, raw)
+	case reflect.TypeOf(&datastore.Key{}), reflect.TypeOf(datastore.Key{}):
+		// Key unescapes the segments, so they are escaped back to be unescaped only once
+		segments := strings.Split(raw, "/")
+		for i := range segments {
+			segments[i] = url.PathEscape(segments[i])
+		}
+		k := reg.Key(strings.Join(segments, "/"))
+		if k == nil {
+			return nil, fmt.Errorf("invalid key path %s", raw)
+		}
+		return k, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, 64)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return filterValue(reg, raw, t.Elem())
+		}
+	}
+	return nil, fmt.Errorf("fields of type %s can't be filtered", t)
+}
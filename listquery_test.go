@@ -0,0 +1,162 @@
+package aeio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+type listQueryTestInvoice struct {
+	Total  int64          `json:"total"`
+	Status string         `json:"status"`
+	Tag    *datastore.Key `json:"tag"`
+}
+
+// scanTestStore applies the filters datastore can't after running the rest of the query, like DatastoreStore, so
+// lists are limited by scanMax.
+type scanTestStore struct {
+	*MemoryStore
+	scanMax int
+}
+
+func (s *scanTestStore) Run(ctx context.Context, q *Query) Iterator {
+	base := *q
+	base.Filters, base.LimitSize, base.OnlyKeys = nil, 0, false
+	var residual []QueryFilter
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "!=", "in", "not-in":
+			residual = append(residual, f)
+		default:
+			base.Filters = append(base.Filters, f)
+		}
+	}
+	return &filteredIterator{ite: s.MemoryStore.Run(ctx, &base), filters: residual, limit: q.LimitSize, keysOnly: q.OnlyKeys, scanMax: s.scanMax}
+}
+
+// listQueryTestKeys returns the ids of the keys of a list response.
+func listQueryTestKeys(t *testing.T, response map[string]interface{}) []int64 {
+	t.Helper()
+	ids := make([]int64, 0)
+	for _, item := range bulkTestResources(t, response) {
+		k := Key(item["key"].(string))
+		if k == nil {
+			t.Fatalf("invalid key in %v", item)
+		}
+		ids = append(ids, k.ID)
+	}
+	return ids
+}
+
+func TestListParams(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterModel("lqinvoice", listQueryTestInvoice{})
+	reg.RegisterModel("lqdeclared", listQueryTestInvoice{})
+	reg.RegisterChild("", "lqinvoice")
+	reg.RegisterChild("", "lqdeclared")
+	reg.RegisterKeyType("lqtag", KeyTypeName)
+	reg.RegisterListFields("lqdeclared", ListFields{Filterable: []string{"status"}, Sortable: []string{"total"}, DefaultSort: []string{"-total"}})
+	store := &scanTestStore{MemoryStore: NewMemoryStore(), scanMax: 4}
+	app, err := New(Config{Store: store, Registry: reg, DisableFirebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	rt := app.NewRouter("")
+
+	rows := []listQueryTestInvoice{
+		{Total: 10, Status: "open", Tag: datastore.NameKey("lqtag", "50%off", nil)},
+		{Total: 20, Status: "paid", Tag: datastore.NameKey("lqtag", "plain", nil)},
+		{Total: 30, Status: "open"},
+		{Total: 40, Status: "void"},
+	}
+	for _, kind := range []string{"lqinvoice", "lqdeclared"} {
+		for i := range rows {
+			k := datastore.IDKey(kind, int64(i+1), nil)
+			_, err = app.Store.Put(context.Background(), k, &Resource{Key: k, Data: &rows[i]})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		code   int
+		want   []int64
+	}{
+		{"eq", "/lqinvoice?filter=status:eq:open", nil, http.StatusOK, []int64{1, 3}},
+		{"range and sort", "/lqinvoice?filter=total:gte:20&sort=-total", nil, http.StatusOK, []int64{4, 3, 2}},
+		{"in", "/lqinvoice?filter=status:in:open,void&sort=total", nil, http.StatusOK, []int64{1, 3, 4}},
+		{"nin", "/lqinvoice?filter=status:nin:open,void", nil, http.StatusOK, []int64{2}},
+		{"ne", "/lqinvoice?filter=status:ne:open&sort=-total", nil, http.StatusOK, []int64{4, 2}},
+		{"sorts", "/lqinvoice?sort=status,-total", nil, http.StatusOK, []int64{3, 1, 2, 4}},
+		{"repeated sorts", "/lqinvoice?sort=status&sort=-total", nil, http.StatusOK, []int64{3, 1, 2, 4}},
+		{"key with the registry key type", "/lqinvoice?filter=tag:eq:/lqtag/plain", nil, http.StatusOK, []int64{2}},
+		{"key with an escaped percent", "/lqinvoice?filter=tag:eq:/lqtag/50%25off", nil, http.StatusOK, []int64{1}},
+		{"keys in", "/lqinvoice?filter=tag:in:/lqtag/plain,/lqtag/50%25off", nil, http.StatusOK, []int64{1, 2}},
+
+		{"malformed", "/lqinvoice?filter=status:eq", nil, http.StatusBadRequest, nil},
+		{"unknown field", "/lqinvoice?filter=color:eq:red", nil, http.StatusBadRequest, nil},
+		{"unknown operator", "/lqinvoice?filter=total:like:1", nil, http.StatusBadRequest, nil},
+		{"bad value", "/lqinvoice?filter=total:eq:ten", nil, http.StatusBadRequest, nil},
+		{"bad value in", "/lqinvoice?filter=total:in:1,ten", nil, http.StatusBadRequest, nil},
+		{"bad key", "/lqinvoice?filter=tag:eq:lqtag", nil, http.StatusBadRequest, nil},
+		{"unknown sort", "/lqinvoice?sort=-color", nil, http.StatusBadRequest, nil},
+
+		{"declared filter", "/lqdeclared?filter=status:eq:open", nil, http.StatusOK, []int64{3, 1}},
+		{"declared sort", "/lqdeclared?sort=total", nil, http.StatusOK, []int64{1, 2, 3, 4}},
+		{"undeclared filter", "/lqdeclared?filter=total:eq:10", nil, http.StatusBadRequest, nil},
+		{"undeclared sort", "/lqdeclared?sort=status", nil, http.StatusBadRequest, nil},
+		{"undeclared header filter", "/lqdeclared", map[string]string{headerFilters: `[{"Field":"Total =","Value":10}]`}, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, res := routerTestServe(t, rt, http.MethodGet, tt.path, "", tt.header)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, res)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if got := listQueryTestKeys(t, res); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the ne, in and nin filters read the rows to apply them, up to ScanMax
+	store.scanMax = 2
+	for filter, code := range map[string]int{"status:ne:paid": http.StatusBadRequest, "status:nin:void": http.StatusBadRequest, "status:eq:open": http.StatusOK} {
+		w, res := routerTestServe(t, rt, http.MethodGet, fmt.Sprintf("/lqinvoice?filter=%s", filter), "", nil)
+		if w.Code != code {
+			t.Fatalf("%s with a scan limit of 2: got %d, want %d: %v", filter, w.Code, code, res)
+		}
+	}
+}
+
+func TestFilterValueRegistry(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterKeyType("lqtag", KeyTypeName)
+	keyType := reflect.TypeOf(&datastore.Key{})
+
+	v, err := filterValue(reg, "/lqtag/100%", keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := v.(*datastore.Key); k.Name != "100%" {
+		t.Fatalf("got name %q, want 100%%", k.Name)
+	}
+
+	// the kind is keyed by ids in other registries
+	if _, err = filterValue(NewRegistry(), "/lqtag/plain", keyType); err == nil {
+		t.Fatal("expected error for a name in a kind keyed by ids")
+	}
+}
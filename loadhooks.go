@@ -0,0 +1,106 @@
+package aeio
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/datastore"
+)
+
+// loadListRow loads a row of a list between its BeforeLoad and AfterLoad hooks, and tells if the caller may read it.
+// On errors the resource is still loaded as far as possible, so it can be responded with the error.
+func (r *Resource) loadListRow(props datastore.PropertyList) (bool, error) {
+	if data, ok := r.Data.(DataBeforeLoad); ok {
+		err := data.BeforeLoad(r)
+		if err != nil {
+			if err := r.Load(props); err != nil {
+				log.Print(err)
+			}
+			return false, errorUnknown.withCause(err).withStack(10)
+		}
+	}
+
+	if err := r.Load(props); err != nil {
+		return false, errorUnknown.withCause(err).withStack(10)
+	}
+
+	if err := r.CheckRules(ActionRead); err != nil {
+		return false, nil
+	}
+
+	if data, ok := r.Data.(DataAfterLoad); ok {
+		err := data.AfterLoad(r)
+		if err != nil {
+			return false, errorUnknown.withCause(err).withStack(10)
+		}
+	}
+	return true, nil
+}
+
+// loadListRows runs loadListRow for the rows read by RunListQuery in hooks.Workers goroutines, and appends the
+// visible ones to r.Resources in the order they were read. Rows are taken in order, so when one fails and no more are
+// taken, all the rows before it are done and the page is responded up to the failed row, like one by one. The rows
+// share a context canceled on the first failure, so hooks still running can give up too, and as they may fail by
+// that, the error returned is the one of the first failure, even if rows before it failed after.
+func (r *Resource) loadListRows(page []Resource, rows []datastore.PropertyList, hooks LoadHooks) error {
+	visible := make([]bool, len(rows))
+	errs := make([]error, len(rows))
+	next := int32(-1)
+	first := int32(-1)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for w := 0; w < minInt(hooks.Workers, len(rows)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if !hooks.SkipFailed && atomic.LoadInt32(&first) >= 0 {
+					return
+				}
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= len(rows) {
+					return
+				}
+				page[i].ctx = ctx
+				visible[i], errs[i] = page[i].loadListRowSafe(rows[i])
+				page[i].ctx = nil
+				if errs[i] != nil && atomic.CompareAndSwapInt32(&first, -1, int32(i)) && !hooks.SkipFailed {
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range rows {
+		if errs[i] != nil {
+			if hooks.SkipFailed {
+				log.Println("skipping", Path(page[i].Key), errs[i])
+				continue
+			}
+			r.Resources = append(r.Resources, &page[i])
+			return errs[first]
+		}
+		if visible[i] {
+			r.Resources = append(r.Resources, &page[i])
+		}
+	}
+	return nil
+}
+
+// loadListRowSafe turns panics of hooks into errors, as they would take the whole server down out of the request
+// goroutine.
+func (r *Resource) loadListRowSafe(props datastore.PropertyList) (visible bool, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = errorUnknown.withCause(fmt.Errorf("panic in load hook: %v", p)).withStack(10).withLog()
+		}
+	}()
+	return r.loadListRow(props)
+}
@@ -0,0 +1,66 @@
+package aeio
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var errLoadHooksTest = errors.New("row failed")
+
+// loadHooksTestItem waits in AfterLoad for the list to be canceled on the row 0, and fails on the row 1.
+type loadHooksTestItem struct {
+	Row int64
+}
+
+func (item *loadHooksTestItem) AfterLoad(r *Resource) error {
+	switch item.Row {
+	case 0:
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("the list was not canceled")
+		}
+	case 1:
+		// let the row 0 start first
+		time.Sleep(20 * time.Millisecond)
+		return errLoadHooksTest
+	}
+	return nil
+}
+
+func TestLoadListRowsFirstFailure(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterModel("lhitem", loadHooksTestItem{})
+	reg.RegisterChild("", "lhitem")
+	reg.RegisterLoadHooks("lhitem", LoadHooks{Workers: 4})
+	app, err := New(Config{Store: NewMemoryStore(), Registry: reg, DisableFirebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	for i := int64(0); i < 4; i++ {
+		k := datastore.IDKey("lhitem", i+1, nil)
+		_, err = app.Store.Put(context.Background(), k, &Resource{Key: k, Data: &loadHooksTestItem{Row: i}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer := http.ResponseWriter(httptest.NewRecorder())
+	r, err := app.NewResourceFromRequest(&writer, httptest.NewRequest(http.MethodGet, "/lhitem", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.RunListQuery(r.listQuery())
+	if !errors.Is(err, errLoadHooksTest) {
+		t.Fatalf("got %v, want the error of the row 1, that failed first", err)
+	}
+}
@@ -0,0 +1,96 @@
+package aeio
+
+import (
+	"fmt"
+)
+
+// Special roles used in permissions, besides the roles of the Principal.
+const (
+	// RoleAnyone allows everybody, even anonymous callers.
+	RoleAnyone = "*"
+	// RoleAuthenticated allows any caller with a verified Principal.
+	RoleAuthenticated = "authenticated"
+	// RoleOwner allows the caller whose Principal.Key is in the resource key path, as /user/5 owns /user/5/order/1.
+	RoleOwner = "owner"
+)
+
+// RegisterPermission allows the action on the kind only to callers with one of the roles.
+// Actions on kinds without permissions registered are not restricted. Calling it again for the same kind and action
+// adds the roles. Put and Allocate check their own action besides the create or update they do, so ActionPut and
+// ActionAllocate restrict only them.
+func RegisterPermission(kind string, action string, roles ...string) {
+	DefaultRegistry.RegisterPermission(kind, action, roles...)
+}
+
+func (reg *Registry) RegisterPermission(kind string, action string, roles ...string) {
+	ValidAction(action)
+	if reg.permissions[kind] == nil {
+		reg.permissions[kind] = make(map[string][]string)
+	}
+	reg.permissions[kind][action] = append(reg.permissions[kind][action], roles...)
+}
+
+// Authorize checks the registered permissions of the action on the resource kind against its Principal.
+// Actions call it before touching the store, so it is only needed for custom operations.
+func (r *Resource) Authorize(action string) error {
+	roles, ok := r.App().Registry.permissions[r.Key.Kind][action]
+	if !ok {
+		return nil
+	}
+
+	if r.HasAnyRole(roles...) {
+		return nil
+	}
+
+	p := r.Principal()
+	err := fmt.Errorf("%s on %s requires one of the roles %v", action, r.Key.Kind, roles)
+	if p == nil {
+		return errorUnauthorized.withCause(err).withStack(10)
+	}
+	return errorForbidden.withCause(err).withStack(10)
+}
+
+// HasAnyRole checks if the caller of the resource has one of the roles, including the special ones.
+func (r *Resource) HasAnyRole(roles ...string) bool {
+	p := r.Principal()
+	for _, role := range roles {
+		switch role {
+		case RoleAnyone:
+			return true
+		case RoleAuthenticated:
+			if p != nil {
+				return true
+			}
+		case RoleOwner:
+			if r.OwnedBy(p) {
+				return true
+			}
+		default:
+			if p.HasRole(role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeAction authorizes only actions called directly, not the ones nested in other actions,
+// like the Get done by Update and Delete.
+func (r *Resource) authorizeAction(action string) error {
+	if len(r.ActionsStack) > 1 {
+		return nil
+	}
+	return r.Authorize(action)
+}
+
+// OwnedBy checks if the principal entity is the resource itself or its nearest ancestor of the same kind.
+func (r *Resource) OwnedBy(p *Principal) bool {
+	if p == nil || p.Key == nil || r.Key == nil {
+		return false
+	}
+	k := r.Key
+	if k.Kind != p.Key.Kind {
+		k = AncestorKindKey(k, p.Key.Kind)
+	}
+	return k != nil && k.Equal(p.Key)
+}
@@ -0,0 +1,146 @@
+package aeio
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Reads and lists respond only the fields named in the fields query string parameter, separated by commas, by json
+// or property name, like GET /company/1/invoice?fields=number,total,status. The key and the errors are always
+// responded, and createdAt, updatedAt and version only if asked. Lists are run as datastore projection queries when
+// the fields allow it, see Resource.projection, and otherwise the whole entities are loaded and the other fields
+// dropped from the response.
+const paramFields = "fields"
+
+// requestFields parses the fields parameter of actions called directly. It returns nil if the request has none.
+func (r *Resource) requestFields() ([]queryField, error) {
+	if len(r.ActionsStack) > 1 || r.Access == nil || r.Access.Request == nil {
+		return nil, nil
+	}
+	param := r.Access.Request.URL.Query().Get(paramFields)
+	if param == "" {
+		return nil, nil
+	}
+
+	known := queryFields(reflect.TypeOf(r.App().Registry.models[r.Key.Kind]))
+	var fields []queryField
+	for _, name := range strings.Split(param, ",") {
+		field, ok := known[strings.TrimSpace(name)]
+		if !ok || field.jsonName == "" {
+			return nil, errorInvalidFields.withHint("Ask for the fields of " + r.Key.Kind).withCause(fmt.Errorf("unknown field %s", name)).withStack(10)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// useFields makes the resource respond only the fields.
+func (r *Resource) useFields(fields []queryField) {
+	if fields == nil {
+		return
+	}
+	r.fields = make([]string, 0, len(fields))
+	for _, field := range fields {
+		r.fields = append(r.fields, field.jsonName)
+	}
+}
+
+// respondsField checks if the json field is responded.
+func (r *Resource) respondsField(jsonName string) bool {
+	if r.fields == nil {
+		return true
+	}
+	for _, name := range r.fields {
+		if name == jsonName {
+			return true
+		}
+	}
+	return false
+}
+
+// projection returns the properties to run the list query as a projection, or nil if it has to load whole entities.
+// Datastore only projects indexed single valued properties not filtered by equality, and the query must project the
+// properties it sorts and filters by inequality too. Kinds with load hooks or read rules always load whole entities,
+// as they may need any field.
+func (r *Resource) projection(q *Query, fields []queryField) []string {
+	if len(fields) == 0 {
+		return nil
+	}
+	data, err := r.App().Registry.NewObject(r.Key.Kind)
+	if err != nil {
+		return nil
+	}
+	if _, ok := data.(DataBeforeLoad); ok {
+		return nil
+	}
+	if _, ok := data.(DataAfterLoad); ok {
+		return nil
+	}
+	if len(r.App().Registry.rules[r.Key.Kind][ActionRead]) > 0 {
+		return nil
+	}
+
+	known := queryFields(reflect.TypeOf(data))
+	var properties []string
+	add := func(field queryField) bool {
+		if field.noindex || !projectable(field.typ) {
+			return false
+		}
+		for _, p := range properties {
+			if p == field.property {
+				return true
+			}
+		}
+		properties = append(properties, field.property)
+		return true
+	}
+
+	for _, field := range fields {
+		if !add(field) {
+			return nil
+		}
+	}
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "=":
+			for _, p := range properties {
+				if p == f.Field {
+					return nil
+				}
+			}
+		case "<", "<=", ">", ">=":
+			field, ok := known[f.Field]
+			if !ok || !add(field) {
+				return nil
+			}
+		default:
+			// filtered out of datastore, see DatastoreStore
+			return nil
+		}
+	}
+	for _, o := range q.Orders {
+		field, ok := known[o.Field]
+		if !ok || !add(field) {
+			return nil
+		}
+	}
+	return properties
+}
+
+// projectable checks if datastore can project properties of the type.
+func projectable(t reflect.Type) bool {
+	switch t {
+	case reflect.TypeOf(time.Time{}), reflect.TypeOf(&datastore.Key{}):
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
@@ -6,29 +6,83 @@ import (
 	"log"
 	"reflect"
 	"regexp"
+	"strings"
 
 	"cloud.google.com/go/datastore"
 )
 
-var validPath = regexp.MustCompile(`^(?:/[a-z-]+/[0-9]+)*(/[a-z-]+)?$`)
+var validPath = regexp.MustCompile(`^(?:/[a-z-]+/[^/]+)*(/[a-z-]+)?$`)
 
-// models allow aeio to instantiate new objects based on keys and paths.
-var models = make(map[string]interface{})
+// Registry holds the models, patchers and paternity rules of an App. Package level Register functions use the
+// DefaultRegistry, which is also the registry of apps created without one.
+type Registry struct {
+	// models allow aeio to instantiate new objects based on keys and paths.
+	models map[string]interface{}
+	// patchers allow aeio to instantiate new patcher objects based on keys and paths.
+	// patchers are useful to allow only some fields of the original model, and use pointers to separate nil and zero values.
+	patchers map[string]interface{}
+	// children allowed to specific models.
+	children map[string]map[string]struct{}
+	// permissions are the roles allowed by kind and action.
+	permissions map[string]map[string][]string
+	// rules are the row level security expressions by kind and action.
+	rules map[string]map[string][]*Rule
+	// keyTypes are the kinds using other than numeric ids.
+	keyTypes map[string]string
+	// strictParents are the kinds whose ancestors must exist on creation.
+	strictParents map[string]struct{}
+	// strongLists are the kinds listed with ancestor queries by default.
+	strongLists map[string]struct{}
+	// transactional are the kinds whose writes always run in a transaction.
+	transactional map[string]struct{}
+	// listFields are the fields lists of the kind may be filtered and sorted by.
+	listFields map[string]ListFields
+	// loadHooks are the options to run the load hooks of list results by kind.
+	loadHooks map[string]LoadHooks
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		models:        make(map[string]interface{}),
+		patchers:      make(map[string]interface{}),
+		children:      make(map[string]map[string]struct{}),
+		permissions:   make(map[string]map[string][]string),
+		rules:         make(map[string]map[string][]*Rule),
+		keyTypes:      make(map[string]string),
+		strictParents: make(map[string]struct{}),
+		strongLists:   make(map[string]struct{}),
+		transactional: make(map[string]struct{}),
+		listFields:    make(map[string]ListFields),
+		loadHooks:     make(map[string]LoadHooks),
+	}
+}
+
+// DefaultRegistry is used by the package level Register functions.
+var DefaultRegistry = NewRegistry()
 
 func RegisterModel(alias string, model interface{}) {
-	if _, ok := models[alias]; ok {
+	DefaultRegistry.RegisterModel(alias, model)
+}
+
+func (reg *Registry) RegisterModel(alias string, model interface{}) {
+	if _, ok := reg.models[alias]; ok {
 		panic("aeio: Register called twice for model " + alias)
 	}
 	// gob.Register(model)
-	models[alias] = model
+	reg.models[alias] = model
 }
 
 func NewObject(alias string) (interface{}, error) {
-	if models[alias] == nil {
+	return DefaultRegistry.NewObject(alias)
+}
+
+func (reg *Registry) NewObject(alias string) (interface{}, error) {
+	if reg.models[alias] == nil {
 		err := errors.New("Model " + alias + " is not implemented/registered.")
 		return nil, errorResourceModelNotImplemented.withCause(err).withStack(10).withLog()
 	}
-	val := reflect.ValueOf(models[alias])
+	val := reflect.ValueOf(reg.models[alias])
 	if val.Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
 	}
@@ -37,24 +91,28 @@ func NewObject(alias string) (interface{}, error) {
 	return newObj, nil
 }
 
-// patchers allow aeio to instantiate new patcher objects based on keys and paths.
-// patchers are useful to allow only some fields of the original model, and use pointers to separate nil and zero values.
-var patchers = make(map[string]interface{})
-
 func RegisterPatcher(alias string, patcher interface{}) {
-	if _, ok := patchers[alias]; ok {
+	DefaultRegistry.RegisterPatcher(alias, patcher)
+}
+
+func (reg *Registry) RegisterPatcher(alias string, patcher interface{}) {
+	if _, ok := reg.patchers[alias]; ok {
 		panic("aeio: Register called twice for patcher " + alias)
 	}
 	// gob.Register(patcher)
-	patchers[alias] = patcher
+	reg.patchers[alias] = patcher
 }
 
 func NewPatcher(alias string) (interface{}, error) {
-	if patchers[alias] == nil {
+	return DefaultRegistry.NewPatcher(alias)
+}
+
+func (reg *Registry) NewPatcher(alias string) (interface{}, error) {
+	if reg.patchers[alias] == nil {
 		err := errors.New("Patcher " + alias + " is not implemented/registered.")
 		return nil, errorResourceModelNotImplemented.withCause(err).withStack(10).withLog()
 	}
-	val := reflect.ValueOf(patchers[alias])
+	val := reflect.ValueOf(reg.patchers[alias])
 	if val.Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
 	}
@@ -63,35 +121,185 @@ func NewPatcher(alias string) (interface{}, error) {
 	return newPatcher, nil
 }
 
-// children allowed to specific models.
-// register them in the init of models, after all models have been registered.
-var children = make(map[string]map[string]struct{})
+// Key types of kinds. Kinds use numeric ids unless registered otherwise.
+const (
+	KeyTypeID   = "id"
+	KeyTypeName = "name"
+)
+
+// RegisterKeyType declares if the kind entities are keyed by numeric ids (datastore.IDKey, the default) or by
+// string names (datastore.NameKey), like /user/alice@example.com.
+func RegisterKeyType(kind string, keyType string) {
+	DefaultRegistry.RegisterKeyType(kind, keyType)
+}
+
+func (reg *Registry) RegisterKeyType(kind string, keyType string) {
+	if keyType != KeyTypeID && keyType != KeyTypeName {
+		panic("aeio: invalid key type " + keyType + " for model " + kind)
+	}
+	reg.keyTypes[kind] = keyType
+}
+
+// KeyType returns the key type of the kind.
+func (reg *Registry) KeyType(kind string) string {
+	if keyType, ok := reg.keyTypes[kind]; ok {
+		return keyType
+	}
+	return KeyTypeID
+}
+
+// RegisterStrictParents makes Create (and the creation by Put and CreateMany) of the kind check that all ancestors
+// in the path really exist, see Resource.CheckAncestors. It costs one extra lookup by creation.
+func RegisterStrictParents(kind string) {
+	DefaultRegistry.RegisterStrictParents(kind)
+}
+
+func (reg *Registry) RegisterStrictParents(kind string) {
+	reg.strictParents[kind] = struct{}{}
+}
+
+// StrictParents checks if the kind was registered with RegisterStrictParents.
+func (reg *Registry) StrictParents(kind string) bool {
+	_, ok := reg.strictParents[kind]
+	return ok
+}
+
+// RegisterStrongLists makes the lists of the kind under a parent strongly consistent by default, so an entity
+// just created is already listed. See Resource.GetMany.
+func RegisterStrongLists(kind string) {
+	DefaultRegistry.RegisterStrongLists(kind)
+}
+
+func (reg *Registry) RegisterStrongLists(kind string) {
+	reg.strongLists[kind] = struct{}{}
+}
+
+// StrongLists checks if the kind was registered with RegisterStrongLists.
+func (reg *Registry) StrongLists(kind string) bool {
+	_, ok := reg.strongLists[kind]
+	return ok
+}
+
+// RegisterTransactional makes Create, Put and Delete of the kind run in a transaction, with their hooks, so a hook
+// error rolls back the write and whatever the hook did on other resources. Update always runs in one. Other kinds
+// only pay for a transaction where the action needs it: Create at a client key, to check nothing is there, and
+// conditional Put and Delete, to check the If-Match and If-None-Match headers. See Resource.RunInTransaction.
+func RegisterTransactional(kind string) {
+	DefaultRegistry.RegisterTransactional(kind)
+}
 
+func (reg *Registry) RegisterTransactional(kind string) {
+	reg.transactional[kind] = struct{}{}
+}
+
+// Transactional checks if the kind was registered with RegisterTransactional.
+func (reg *Registry) Transactional(kind string) bool {
+	_, ok := reg.transactional[kind]
+	return ok
+}
+
+// ListFields declares how lists of a kind may be filtered and sorted. Fields are named like in the filter and sort
+// query parameters, by their json names or property names.
+type ListFields struct {
+	Filterable []string `json:"filterable"`
+	Sortable   []string `json:"sortable"`
+	// DefaultSort is used when the request has no sort, with "-" prefixed fields descending, like "-createdAt".
+	DefaultSort []string `json:"defaultSort,omitempty"`
+}
+
+// RegisterListFields restricts the filters and sorts of lists of the kind to the declared fields, including the ones
+// of the X-Filters and X-Sorters headers. Kinds without them take any field. Each field needs its datastore indexes.
+// The model must be registered before, as it panics on names that are not fields of it.
+func RegisterListFields(kind string, fields ListFields) {
+	DefaultRegistry.RegisterListFields(kind, fields)
+}
+
+func (reg *Registry) RegisterListFields(kind string, fields ListFields) {
+	known := queryFields(reflect.TypeOf(reg.models[kind]))
+	if known == nil {
+		panic("aeio: RegisterListFields called for model " + kind + " that is not registered")
+	}
+	check := func(name string) {
+		if _, ok := known[name]; !ok {
+			panic(fmt.Sprintf("aeio: list field %s is not a field of model %s", name, kind))
+		}
+	}
+	for _, name := range fields.Filterable {
+		check(name)
+	}
+	for _, name := range fields.Sortable {
+		check(name)
+	}
+	for _, name := range fields.DefaultSort {
+		check(strings.TrimPrefix(name, "-"))
+	}
+	reg.listFields[kind] = fields
+}
+
+// ListFields returns the list fields declared for the kind, and false if there are none.
+func (reg *Registry) ListFields(kind string) (ListFields, bool) {
+	fields, ok := reg.listFields[kind]
+	return fields, ok
+}
+
+// LoadHooks tells how RunListQuery runs the BeforeLoad and AfterLoad hooks of the rows of a kind.
+type LoadHooks struct {
+	// Workers is how many rows have their hooks run at once. 0 or 1 runs them one by one.
+	Workers int
+	// SkipFailed leaves the rows whose hooks fail out of the page, logging the error, instead of failing the list.
+	SkipFailed bool
+}
+
+// RegisterLoadHooks sets how the load hooks of the kind run in lists. Running them concurrently pays off when hooks
+// fetch related data, but then they must be safe for concurrent use, as they share the Access of the request.
+func RegisterLoadHooks(kind string, hooks LoadHooks) {
+	DefaultRegistry.RegisterLoadHooks(kind, hooks)
+}
+
+func (reg *Registry) RegisterLoadHooks(kind string, hooks LoadHooks) {
+	reg.loadHooks[kind] = hooks
+}
+
+// LoadHooks returns the load hooks options of the kind, one by one and failing on errors by default.
+func (reg *Registry) LoadHooks(kind string) LoadHooks {
+	return reg.loadHooks[kind]
+}
+
+// RegisterChild allows the child kind under the parent kind.
+// register them in the init of models, after all models have been registered.
 func RegisterChild(parent string, child string) {
+	DefaultRegistry.RegisterChild(parent, child)
+}
+
+func (reg *Registry) RegisterChild(parent string, child string) {
 	// if parent != "" && models[parent] == nil {
 	// 	panic(fmt.Sprintln("parent model", parent, "is not registered or defined"))
 	// }
 	// if child == "" || models[child] == nil {
 	// 	panic(fmt.Sprintln("model", child, "is not registered or defined"))
 	// }
-	if children[parent] == nil {
-		children[parent] = make(map[string]struct{})
+	if reg.children[parent] == nil {
+		reg.children[parent] = make(map[string]struct{})
 	}
-	children[parent][child] = struct{}{}
+	reg.children[parent][child] = struct{}{}
 }
 
 // CheckRegistry verifies if all relationships are for registered objects.
 func CheckRegistry(print bool) {
+	DefaultRegistry.CheckRegistry(print)
+}
+
+func (reg *Registry) CheckRegistry(print bool) {
 	if print {
-		log.Println(models)
-		log.Println(children)
+		log.Println(reg.models)
+		log.Println(reg.children)
 	}
-	for parent, children := range children {
+	for parent, children := range reg.children {
 		for child := range children {
-			if parent != "" && models[parent] == nil {
+			if parent != "" && reg.models[parent] == nil {
 				log.Panicln("parent model", parent, "is not registered or defined")
 			}
-			if child == "" || models[child] == nil {
+			if child == "" || reg.models[child] == nil {
 				log.Panicln("child model", child, "is not registered or defined")
 			}
 		}
@@ -100,7 +308,11 @@ func CheckRegistry(print bool) {
 
 // ValidatePaternity simply verifies that the parent key can have this kind of child.
 func ValidatePaternity(p string, c string) error {
-	_, ok := children[p][c]
+	return DefaultRegistry.ValidatePaternity(p, c)
+}
+
+func (reg *Registry) ValidatePaternity(p string, c string) error {
+	_, ok := reg.children[p][c]
 	if !ok {
 		err := errors.New("[" + p + "] kind doesn't accept the paternity of [" + c + "] kids. You should register it first.")
 		return errorInvalidResourceChild.withCause(err).withStack(10)
@@ -110,19 +322,31 @@ func ValidatePaternity(p string, c string) error {
 
 // ValidateKey checks if the key chain is valid, but don't check the existence of parents in datastore.
 func ValidateKey(k *datastore.Key) error {
+	return DefaultRegistry.ValidateKey(k)
+}
+
+func (reg *Registry) ValidateKey(k *datastore.Key) error {
 	if k == nil {
 		return errorInvalidPath.withStack(10).withLog()
 	}
 	var level = 0
 	for {
 		kind := k.Kind
-		if level != 0 && k.ID == 0 {
+		if level != 0 && k.Incomplete() {
 			return errorInvalidPath.withHint(fmt.Sprintf("key id 0 at level %d", level))
 		}
+		if !k.Incomplete() {
+			if reg.KeyType(kind) == KeyTypeName && k.Name == "" {
+				return errorInvalidPath.withHint(fmt.Sprintf("kind %s uses name keys, not ids", kind))
+			}
+			if reg.KeyType(kind) == KeyTypeID && k.ID == 0 {
+				return errorInvalidPath.withHint(fmt.Sprintf("kind %s uses id keys, not names", kind))
+			}
+		}
 
 		if k.Parent != nil {
 			k = k.Parent
-			err := ValidatePaternity(k.Kind, kind)
+			err := reg.ValidatePaternity(k.Kind, kind)
 			if err != nil {
 				return err
 			}
@@ -130,7 +354,7 @@ func ValidateKey(k *datastore.Key) error {
 			continue
 		}
 		// no more parents, test for root ""
-		err := ValidatePaternity("", k.Kind)
+		err := reg.ValidatePaternity("", k.Kind)
 		if err != nil {
 			return err
 		}
@@ -169,10 +393,16 @@ const (
 	ActionReadMany = "GET-MANY"
 	ActionReadAny  = "GET-ANY"
 	ActionUpdate   = "UPDATE"
+	ActionPut      = "PUT"
 	ActionDelete   = "DELETE"
 	ActionError    = "ERROR"
+	ActionAllocate = "ALLOCATE"
 
 	ActionReadManyCount = "GET-MANY-COUNT"
+
+	ActionCreateMany = "CREATE-MANY"
+	ActionUpdateMany = "UPDATE-MANY"
+	ActionDeleteMany = "DELETE-MANY"
 )
 
 var actions = map[string]struct{}{
@@ -182,8 +412,13 @@ var actions = map[string]struct{}{
 	ActionReadManyCount: {},
 	ActionReadAny:       {},
 	ActionUpdate:        {},
+	ActionPut:           {},
 	ActionDelete:        {},
 	ActionError:         {},
+	ActionAllocate:      {},
+	ActionCreateMany:    {},
+	ActionUpdateMany:    {},
+	ActionDeleteMany:    {},
 }
 
 // func RegisterAction(action string) {
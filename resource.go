@@ -1,12 +1,12 @@
 package aeio
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"reflect"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -24,6 +24,8 @@ type Resource struct {
 	Data           interface{}    `datastore:"-" json:"data,omitempty"`
 	error          error          `datastore:"-"`
 	CreatedAt      time.Time      `datastore:"-" json:"createdAt,omitempty"`
+	UpdatedAt      time.Time      `datastore:"-" json:"updatedAt,omitempty"`
+	Version        int64          `datastore:"-" json:"version,omitempty"`
 	Access         *Access        `datastore:"-" json:"-"`
 	ActionsStack   []string       `datastore:"-" json:"-"`
 	ActionsHistory []string       `datastore:"-" json:"-"`
@@ -31,6 +33,13 @@ type Resource struct {
 	ResourcesCount *int           `datastore:"-" json:"resourcesCount,omitempty"`
 	Next           string         `datastore:"-" json:"next"`
 	TimeElapsed    int64          `datastore:"-" json:"timeElapsed,omitempty"`
+
+	// tx is the transaction the actions of the resource read and write through, see UseTransaction.
+	tx Transaction
+	// fields are the json names of the fields to respond, or nil for all. See the fields parameter.
+	fields []string
+	// ctx replaces the request context, like for the rows of a list whose hooks run concurrently. See Context.
+	ctx context.Context
 }
 
 type DataBeforeSave interface {
@@ -66,9 +75,15 @@ type DataBind interface {
 // 	return NewResource(parentResource.Access, parentResource.Key, listKind)
 // }
 
-// Save puts the object into datastore, inlining resource CreatedAt and Parent Key into the object.
-// TODO: the problem with repeated CreatedAt on objects is to access directly the datastore without the resource, which \
-//  happens in transactions. We could pass, optionally, a transaction to actions, and this problem would be gone.
+// Properties holding the UpdatedAt and Version of the resource. They are reserved, so models may have fields of the
+// same names.
+const (
+	propertyUpdatedAt = "_aeioUpdatedAt"
+	propertyVersion   = "_aeioVersion"
+)
+
+// Save puts the object into datastore, inlining resource CreatedAt, UpdatedAt, Version and Parent Key into the object.
+// Writes done in transactions should go through resource actions (see UseTransaction) to keep these fields.
 // TODO: it's possible that modern datastore has already the parent field
 func (r *Resource) Save() (ps []datastore.Property, err error) {
 	r.CreatedAt = NoZeroTime(r.CreatedAt)
@@ -81,19 +96,23 @@ func (r *Resource) Save() (ps []datastore.Property, err error) {
 	hasCreatedAt := false
 	hasParent := false
 	for _, v := range ps {
-		if v.Name == "CreatedAt" {
+		switch v.Name {
+		case "CreatedAt":
 			hasCreatedAt = true
-			continue
-		}
-		if v.Name == "Parent" {
+		case "Parent":
 			hasParent = true
-			continue
 		}
 	}
 
 	if !hasCreatedAt {
 		ps = append(ps, datastore.Property{Name: "CreatedAt", Value: r.CreatedAt})
 	}
+	if !r.UpdatedAt.IsZero() {
+		ps = append(ps, datastore.Property{Name: propertyUpdatedAt, Value: r.UpdatedAt})
+	}
+	if r.Version != 0 {
+		ps = append(ps, datastore.Property{Name: propertyVersion, Value: r.Version})
+	}
 
 	if r.Key != nil {
 		if !hasParent {
@@ -103,13 +122,20 @@ func (r *Resource) Save() (ps []datastore.Property, err error) {
 	return ps, nil
 }
 
-// Load extracts the datastore data into an object, taking CreatedAt and Parent off the object.
+// Load extracts the datastore data into an object, taking CreatedAt, UpdatedAt, Version and Parent off the object.
+// Entities saved before versioning load as version 0.
 func (r *Resource) Load(ps []datastore.Property) (err error) {
 	var ps2 []datastore.Property
+	r.UpdatedAt = time.Time{}
+	r.Version = 0
 	for _, p := range ps {
 		switch p.Name {
 		case "CreatedAt":
-			r.CreatedAt = NoZeroTime(p.Value.(time.Time))
+			r.CreatedAt = NoZeroTime(propertyTime(p.Value))
+		case propertyUpdatedAt:
+			r.UpdatedAt = propertyTime(p.Value)
+		case propertyVersion:
+			r.Version, _ = p.Value.(int64)
 		case "Parent":
 		default:
 			ps2 = append(ps2, p)
@@ -119,16 +145,52 @@ func (r *Resource) Load(ps []datastore.Property) (err error) {
 	return
 }
 
+// propertyTime reads a time property, which projections may return as int64 microseconds. Other values are the zero
+// time.
+func propertyTime(v interface{}) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case int64:
+		return time.Unix(0, v*int64(time.Microsecond))
+	}
+	return time.Time{}
+}
+
+// App returns the App the resource belongs to, through its Access. Resources without one use the default App.
+func (r *Resource) App() *App {
+	return accessApp(r.Access)
+}
+
+// Context returns the context of the resource actions, which is the request one, or the one of the list page for
+// rows whose load hooks run concurrently, canceled when a row fails. Hooks should use it for their own calls.
+func (r *Resource) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.Access == nil || r.Access.Request == nil {
+		return r.App().Context
+	}
+	return r.Access.Request.Context()
+}
+
+// Set stashes a request scoped value on the resource Access. See Access.Set.
+func (r *Resource) Set(key string, value interface{}) {
+	r.Access.Set(key, value)
+}
+
+// Value returns a request scoped value stashed on the resource Access. See Access.Value.
+func (r *Resource) Value(key string) interface{} {
+	return r.Access.Value(key)
+}
+
 // NewData initializes the Data object with the provided alias type
 func (r *Resource) NewData(kind string) error {
-	if models[kind] == nil {
-		return errorResourceModelNotImplemented.withStack(10)
-	}
-	val := reflect.ValueOf(models[kind])
-	if val.Kind() == reflect.Ptr {
-		val = reflect.Indirect(val)
+	data, err := r.App().Registry.NewObject(kind)
+	if err != nil {
+		return err
 	}
-	r.Data = reflect.New(val.Type()).Interface()
+	r.Data = data
 	return nil
 }
 
@@ -136,6 +198,22 @@ func (r *Resource) NewData(kind string) error {
 // and on specifically action UPDATE will bind only allowed fields. This is useful for locking fields on
 // the original state.
 func (r *Resource) BindRequestData() error {
+	if r.Access.Request.ContentLength < 2 {
+		return errorEmptyRequestBody.withStack(10)
+	}
+
+	bodyContent, err := r.Access.Body()
+	if err != nil {
+		return errorRequestBodyRead.withCause(err).withStack(10)
+	}
+
+	return r.BindData(bodyContent)
+}
+
+// BindData is like BindRequestData, but takes the json data apart from the request, like each item of bulk requests.
+// Resources on ActionUpdate and ActionUpdateMany are patched. Binding errors are already described, like a 403 for
+// fields not writable, so actions return them as they are.
+func (r *Resource) BindData(bodyContent []byte) error {
 	var err error
 	if r.Data == nil {
 		err = r.NewData(r.Key.Kind)
@@ -144,16 +222,12 @@ func (r *Resource) BindRequestData() error {
 		}
 	}
 
-	if r.Access.Request.ContentLength < 2 {
-		return errorEmptyRequestBody.withStack(10)
-	}
-
-	bodyContent, err := ioutil.ReadAll(r.Access.Request.Body)
+	bodyContent, err = r.writableBody(bodyContent)
 	if err != nil {
-		return errorRequestBodyRead.withCause(err).withStack(10)
+		return err
 	}
 
-	if !r.AssertAction(ActionUpdate) {
+	if !r.AssertAction(ActionUpdate) && !r.AssertAction(ActionUpdateMany) {
 		// load directly into r.Data
 		err = json.Unmarshal(bodyContent, &r.Data)
 		if err != nil {
@@ -168,9 +242,9 @@ func (r *Resource) BindRequestData() error {
 
 	// create patcher temporary object
 	var patcher interface{}
-	patcher, err = NewPatcher(r.Key.Kind)
+	patcher, err = r.App().Registry.NewPatcher(r.Key.Kind)
 	if err != nil {
-		patcher, err = NewObject(r.Key.Kind)
+		patcher, err = r.App().Registry.NewObject(r.Key.Kind)
 		if err != nil {
 			return errorRequestUnmarshal.withCause(err).withStack(10).withLog()
 		}
@@ -228,47 +302,95 @@ func (r *Resource) CopyData(dst *Resource) error {
 
 func (r *Resource) MarshalJSON() ([]byte, error) {
 	type Alias Resource
+	data, err := r.readableData()
+	if err != nil {
+		return nil, err
+	}
+	// denied and missing resources may hold the stored data, or an empty one, and neither is for the caller
+	var e complexError
+	if errors.As(r.error, &e) {
+		switch e.Code {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			data = nil
+		}
+	}
+	// the meta fields are pointers so the ones not asked with the fields parameter are left out
+	var createdAt, updatedAt *time.Time
+	var version *int64
+	if r.respondsField("createdAt") {
+		t := NoZeroTime(r.CreatedAt)
+		createdAt = &t
+	}
+	if r.respondsField("updatedAt") && !r.UpdatedAt.IsZero() {
+		updatedAt = &r.UpdatedAt
+	}
+	if r.respondsField("version") && r.Version != 0 {
+		version = &r.Version
+	}
 	return json.Marshal(&struct {
-		Path      string    `json:"key"`
-		Error     error     `json:"error"`
-		CreatedAt time.Time `json:"createdAt"`
+		Path      string      `json:"key"`
+		Error     error       `json:"error"`
+		CreatedAt *time.Time  `json:"createdAt,omitempty"`
+		UpdatedAt *time.Time  `json:"updatedAt,omitempty"`
+		Version   *int64      `json:"version,omitempty"`
+		Data      interface{} `json:"data,omitempty"`
 		*Alias
 	}{
 		Path:      Path(r.Key),
 		Error:     r.error,
-		CreatedAt: NoZeroTime(r.CreatedAt),
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+		Version:   version,
+		Data:      data,
 		Alias:     (*Alias)(r),
 	})
 }
 
-// CheckAncestors verifies the path for full validity. First it checks for chain paternity issues. Second it check if ancestors really exist in the datastore.
+// CheckAncestors verifies the path for full validity. First it checks for chain paternity issues. Second it check if ancestors really exist in the datastore,
+// all of them with a single GetMulti (through the resource transaction, if any). The error names the missing ancestor nearest to the root.
 // This means that change to paternity rules or deleted ancestors will block the creation of a new child.
-// TODO: Should use BatchQuery.
+// Creations call it for kinds registered with RegisterStrictParents.
 func (r *Resource) CheckAncestors() error {
 	var err error
-	var k = r.Key
-	err = ValidateKey(r.Key)
+	err = r.App().Registry.ValidateKey(r.Key)
 	if err != nil {
 		return err
 	}
+
+	// root first
+	var keys []*datastore.Key
+	for k := r.Key.Parent; k != nil; k = k.Parent {
+		keys = append([]*datastore.Key{k}, keys...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
 	// test existence
-	for {
-		if k.Parent != nil {
-			k = k.Parent
-			q := datastore.NewQuery(k.Kind).Filter("__key__ =", k).KeysOnly()
-			var c int
-			c, err = DatastoreClient.Count(r.Access.Request.Context(), q)
+	err = r.storeGetMulti(keys, make([]datastore.PropertyList, len(keys)))
+	if errs, ok := err.(datastore.MultiError); ok {
+		for i, err := range errs {
+			if errors.Is(err, datastore.ErrNoSuchEntity) {
+				return errorDatastoreAncestorNotFound.withCause(fmt.Errorf("ancestor %s not found", Path(keys[i]))).withHint(fmt.Sprintf("Create %s before its children", Path(keys[i]))).withStack(10)
+			}
+		}
+		for _, err := range errs {
 			if err != nil {
 				return errorDatastoreCount.withCause(err).withStack(10)
 			}
-			if c == 0 {
-				err = fmt.Errorf(Path(k))
-				return errorDatastoreAncestorNotFound.withCause(err).withStack(10)
-			}
-		} else {
-			return nil
 		}
+	} else if err != nil {
+		return errorDatastoreCount.withCause(err).withStack(10)
 	}
+	return nil
+}
+
+// checkStrictParents runs CheckAncestors on creations of kinds registered with RegisterStrictParents.
+func (r *Resource) checkStrictParents() error {
+	if !r.App().Registry.StrictParents(r.Key.Kind) {
+		return nil
+	}
+	return r.CheckAncestors()
 }
 
 // func (r *Resource) Cross(key **datastore.Key, path *string) (ok bool) {
@@ -509,28 +631,18 @@ func (r *Resource) ExitAction(action string) {
 // If the resource errors contains the reference "not_authorized", the status will be http.StatusForbidden (403) independently
 // of the status passed to Respond.
 func (r *Resource) Respond(err error) {
-	var status = http.StatusOK
-
-	if err != nil {
-		switch err.(type) {
-		case complexError:
-			break
-		case error:
-			err = errorUnknown.withCause(err)
-			break
-		}
-
-		r.error = err
-		status = err.(complexError).Code
-		if http.StatusText(status) == "" {
-			r.error = errorInvalidHttpStatusCode.withCause(err).withStack(10)
-		}
-	}
+	status := r.setError(err)
 
 	if r.Access.Writer.Header().Get("Content-Type") == "" {
 		r.Access.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 	}
 
+	if isNotModified(err) {
+		r.Access.Writer.WriteHeader(status)
+		log.Printf("%d %s %s", status, r.Access.Request.Method, r.Access.Request.URL.Path)
+		return
+	}
+
 	if err != nil {
 		r.Access.Writer.WriteHeader(status)
 		log.Printf("%d %s %s error: %+v", status, r.Access.Request.Method, r.Access.Request.URL.Path, err)
@@ -549,6 +661,29 @@ func (r *Resource) Respond(err error) {
 	}
 }
 
+// setError attaches the error to the resource as a complexError, returning the http status it causes.
+func (r *Resource) setError(err error) int {
+	var status = http.StatusOK
+
+	if err != nil {
+		switch err.(type) {
+		case complexError:
+			break
+		case error:
+			err = errorUnknown.withCause(err)
+			break
+		}
+
+		r.error = err
+		status = err.(complexError).Code
+		if http.StatusText(status) == "" {
+			r.error = errorInvalidHttpStatusCode.withCause(err).withStack(10)
+		}
+	}
+
+	return status
+}
+
 // Timing is used to time the processing of resources.
 func (r *Resource) Timing(start time.Time) {
 	r.TimeElapsed = int64(time.Since(start) / time.Millisecond)
@@ -1,32 +1,328 @@
 package aeio
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
 )
 
 var ServerHost = ""
 var ServerPort = "8080"
 
+// Serve serves the router with the default App. See App.Serve.
 func Serve(router http.Handler) error {
+	err := Default().Serve(router)
+	ContextCancel()
+	return err
+}
+
+// Serve listens on the configured address, unix socket or TLS, and serves the handler until SIGTERM or SIGINT
+// is received or the App context is canceled. Then it stops accepting connections, drains the in-flight requests
+// up to the shutdown timeout and closes the App.
+// The PORT env variable overrides the configured port, and in development mode only 127.0.0.1 is listened.
+// It returns nil after a graceful shutdown.
+func (app *App) Serve(handler http.Handler) error {
 	var err error
 
-	if Development {
-		ServerHost = "127.0.0.1"
+	host := app.Config.ServerHost
+	if app.Config.Development {
+		host = "127.0.0.1"
+	}
+
+	port := app.Config.ServerPort
+	if os.Getenv("PORT") != "" {
+		port = os.Getenv("PORT")
+	}
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf("%s:%s", host, port),
+		Handler:      handler,
+		ReadTimeout:  app.Config.ReadTimeout,
+		WriteTimeout: app.Config.WriteTimeout,
+		IdleTimeout:  app.Config.IdleTimeout,
+	}
+
+	var listener net.Listener
+	if app.Config.UnixSocket != "" {
+		// a socket file left by a previous run would block listening
+		_ = os.Remove(app.Config.UnixSocket)
+		listener, err = net.Listen("unix", app.Config.UnixSocket)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(app.Config.UnixSocket)
+		log.Printf("Serving HTTP on unix socket %s", app.Config.UnixSocket)
+	} else {
+		listener, err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Serving HTTP on %s", server.Addr)
 	}
 
-	port := os.Getenv("PORT")
-	if port != "" {
-		ServerPort = port
-		// ServerHost = ""
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		if app.Config.TLSCertFile != "" {
+			served <- server.ServeTLS(listener, app.Config.TLSCertFile, app.Config.TLSKeyFile)
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err = <-served:
+		// serving failed before any shutdown request
+		app.Close()
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case <-app.Context.Done():
+		log.Print("Context canceled, shutting down")
 	}
-	connectionString := fmt.Sprintf("%s:%s", ServerHost, ServerPort)
 
-	log.Printf("Serving HTTP on %s", connectionString)
-	err = http.ListenAndServe(connectionString, router)
-	// if listenAndServe is ok, will stay running (blocking)
-	// returns only in error (withCause will always be true)
+	ctx := context.Background()
+	if app.Config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.Config.ShutdownTimeout)
+		defer cancel()
+	}
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Print("error_draining_requests:", err)
+	}
+
+	app.Close()
 	return err
 }
+
+// Router is an http.Handler that parses the resource path, selects the action by the request method and by the
+// completeness of the key, runs the handler and responds:
+// POST on kind is Create, GET on kind is GetMany, GET on id is Get, PATCH on id is Update, PUT on id is Put (create or
+// replace) and DELETE on id is Delete. POST on id creates with that id, POST on kind with ?allocate is Allocate,
+// POST on kind with a json array body is CreateMany, and PATCH and DELETE on kind are UpdateMany and DeleteMany.
+// BatchPath and KindsPath are not kinds, they serve batches of requests and the description of the kinds.
+// Handlers may be overridden per kind and action with Handle.
+type Router struct {
+	// App used by the resources. If nil, the default App.
+	App *App
+	// Prefix is the mount point of the router, removed from the url path before parsing it, e.g. "/api".
+	Prefix string
+
+	handlers          map[string]map[string]Handler
+	middlewares       []Middleware
+	kindMiddlewares   map[string][]Middleware
+	actionMiddlewares map[string]map[string][]Middleware
+}
+
+// NewRouter returns a Router for the default App, mounted on prefix.
+func NewRouter(prefix string) *Router {
+	return &Router{Prefix: strings.TrimRight(prefix, "/")}
+}
+
+// NewRouter returns a Router for the App, mounted on prefix.
+func (app *App) NewRouter(prefix string) *Router {
+	return &Router{App: app, Prefix: strings.TrimRight(prefix, "/")}
+}
+
+// Handle overrides the handler of the action for the kind.
+func (rt *Router) Handle(kind string, action string, handler Handler) {
+	ValidAction(action)
+	if rt.handlers == nil {
+		rt.handlers = make(map[string]map[string]Handler)
+	}
+	if rt.handlers[kind] == nil {
+		rt.handlers[kind] = make(map[string]Handler)
+	}
+	rt.handlers[kind][action] = handler
+}
+
+// Use adds middlewares that run for all requests. They also run for the requests to BatchPath and KindsPath, where
+// the resource has no key, and again for each operation of a batch.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+}
+
+// UseKind adds middlewares that run for all actions on the kind, after the global ones.
+func (rt *Router) UseKind(kind string, middlewares ...Middleware) {
+	if rt.kindMiddlewares == nil {
+		rt.kindMiddlewares = make(map[string][]Middleware)
+	}
+	rt.kindMiddlewares[kind] = append(rt.kindMiddlewares[kind], middlewares...)
+}
+
+// UseAction adds middlewares that run only for the action on the kind, after the global and kind ones.
+// An empty kind applies them to the action on all kinds.
+func (rt *Router) UseAction(kind string, action string, middlewares ...Middleware) {
+	ValidAction(action)
+	if rt.actionMiddlewares == nil {
+		rt.actionMiddlewares = make(map[string]map[string][]Middleware)
+	}
+	if rt.actionMiddlewares[kind] == nil {
+		rt.actionMiddlewares[kind] = make(map[string][]Middleware)
+	}
+	rt.actionMiddlewares[kind][action] = append(rt.actionMiddlewares[kind][action], middlewares...)
+}
+
+// handler returns the handler for kind and action wrapped by its middlewares, or nil if there is none.
+func (rt *Router) handler(kind string, action string) Handler {
+	h, ok := rt.handlers[kind][action]
+	if !ok {
+		h = actionHandlers[action]
+	}
+	if h == nil {
+		return nil
+	}
+
+	var middlewares []Middleware
+	middlewares = append(middlewares, rt.middlewares...)
+	middlewares = append(middlewares, rt.kindMiddlewares[kind]...)
+	middlewares = append(middlewares, rt.actionMiddlewares[""][action]...)
+	if kind != "" {
+		middlewares = append(middlewares, rt.actionMiddlewares[kind][action]...)
+	}
+	return Chain(h, middlewares...)
+}
+
+func (rt *Router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+
+	app := rt.App
+	if app == nil {
+		app = Default()
+	}
+
+	// names in paths may have escaped slashes, so the path is only unescaped by segment when parsed
+	path := request.URL.EscapedPath()
+	if rt.Prefix != "" {
+		path = strings.TrimPrefix(path, rt.Prefix)
+		if path == request.URL.EscapedPath() || !strings.HasPrefix(path, "/") {
+			r := &Resource{Access: newAccess(app, &writer, request)}
+			r.Respond(errorRouteNotFound.withHint(fmt.Sprintf("The path must start with %s", rt.Prefix)))
+			return
+		}
+	}
+
+	if path == BatchPath {
+		rt.serveEndpoint(app, writer, request, func(r *Resource) error {
+			return rt.serveBatch(r, start)
+		})
+		return
+	}
+	if path == KindsPath {
+		rt.serveEndpoint(app, writer, request, func(r *Resource) error {
+			return rt.serveKinds(r, start)
+		})
+		return
+	}
+
+	r, err := app.newResourceFromPath(&writer, request, path)
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+
+	action, err := routeAction(request, r.Key)
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+
+	handler := rt.handler(r.Key.Kind, action)
+	if handler == nil {
+		r.Respond(errorMethodNotAllowed.withStack(10))
+		return
+	}
+	if app.Authenticator != nil {
+		handler = Authenticate(app.Authenticator)(handler)
+	}
+
+	err = handler(r)
+	r.Timing(start)
+	r.Respond(err)
+}
+
+// serveEndpoint runs the handler of a path of the router that is not a kind, like BatchPath and KindsPath, behind the
+// authenticator and the middlewares added with Use, as the kind handlers. The resource has no key, and the handler
+// writes the response itself, unless it fails.
+func (rt *Router) serveEndpoint(app *App, writer http.ResponseWriter, request *http.Request, handler Handler) {
+	r := &Resource{Access: newAccess(app, &writer, request)}
+	handler = Chain(handler, rt.middlewares...)
+	if app.Authenticator != nil {
+		handler = Authenticate(app.Authenticator)(handler)
+	}
+	err := handler(r)
+	if err != nil {
+		r.Respond(err)
+	}
+}
+
+// routeAction maps the request method on a key to the action. A POST with the allocate query parameter reserves
+// ids instead of creating, and a POST on a complete key creates only if there is nothing there yet.
+// On kinds, a POST of a json array creates many, and PATCH and DELETE work on many.
+func routeAction(request *http.Request, key *datastore.Key) (string, error) {
+	method := request.Method
+	if key.Incomplete() {
+		switch method {
+		case http.MethodPost:
+			if _, ok := request.URL.Query()["allocate"]; ok {
+				return ActionAllocate, nil
+			}
+			if isJSONArray(request) {
+				return ActionCreateMany, nil
+			}
+			return ActionCreate, nil
+		case http.MethodGet:
+			return ActionReadMany, nil
+		case http.MethodPatch:
+			return ActionUpdateMany, nil
+		case http.MethodDelete:
+			return ActionDeleteMany, nil
+		}
+	} else {
+		switch method {
+		case http.MethodGet:
+			return ActionRead, nil
+		case http.MethodPost:
+			return ActionCreate, nil
+		case http.MethodPatch:
+			return ActionUpdate, nil
+		case http.MethodPut:
+			return ActionPut, nil
+		case http.MethodDelete:
+			return ActionDelete, nil
+		}
+	}
+	return "", errorMethodNotAllowed.withHint(fmt.Sprintf("%s is not allowed on %s", method, Path(key))).withStack(10)
+}
+
+// isJSONArray peeks the start of the request body, without consuming it, to tell if it holds a json array.
+func isJSONArray(request *http.Request) bool {
+	if request.Body == nil {
+		return false
+	}
+	reader := bufio.NewReader(request.Body)
+	request.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, request.Body}
+
+	start, _ := reader.Peek(64)
+	start = bytes.TrimLeft(start, " \t\r\n")
+	return len(start) > 0 && start[0] == '['
+}
@@ -0,0 +1,141 @@
+package aeio
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type routerTestCompany struct {
+	Name string `json:"name"`
+}
+
+type routerTestInvoice struct {
+	Total  int64  `json:"total"`
+	Status string `json:"status"`
+}
+
+// newRouterTestApp returns an App over a MemoryStore, with companies at the root and invoices under them.
+func newRouterTestApp(t *testing.T) *App {
+	t.Helper()
+	reg := NewRegistry()
+	reg.RegisterModel("rtcompany", routerTestCompany{})
+	reg.RegisterModel("rtinvoice", routerTestInvoice{})
+	reg.RegisterChild("", "rtcompany")
+	reg.RegisterChild("rtcompany", "rtinvoice")
+	app, err := New(Config{Store: NewMemoryStore(), Registry: reg, DisableFirebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+// routerTestServe serves the request and decodes the json response.
+func routerTestServe(t *testing.T, h http.Handler, method string, path string, body string, header map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	writer := httptest.NewRecorder()
+	h.ServeHTTP(writer, request)
+	var response map[string]interface{}
+	if writer.Body.Len() > 0 {
+		if err := json.Unmarshal(writer.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, writer.Body.String())
+		}
+	}
+	return writer, response
+}
+
+// routerTestData returns the data object of a response, or nil.
+func routerTestData(response map[string]interface{}) map[string]interface{} {
+	data, _ := response["data"].(map[string]interface{})
+	return data
+}
+
+func TestRouterMemoryStore(t *testing.T) {
+	app := newRouterTestApp(t)
+	rt := app.NewRouter("/api/")
+
+	w, res := routerTestServe(t, rt, http.MethodPost, "/api/rtcompany", `{"name":"acme"}`, nil)
+	if w.Code != http.StatusOK || routerTestData(res)["name"] != "acme" {
+		t.Fatalf("create: %d %v", w.Code, res)
+	}
+	company, _ := res["key"].(string)
+	if company == "" {
+		t.Fatalf("create returned no key: %v", res)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodGet, "/api"+company, "", nil)
+	if w.Code != http.StatusOK || routerTestData(res)["name"] != "acme" || w.Header().Get("ETag") == "" {
+		t.Fatalf("get: %d %v %v", w.Code, res, w.Header())
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodPatch, "/api"+company, `{"name":"acme inc"}`, nil)
+	if w.Code != http.StatusOK || routerTestData(res)["name"] != "acme inc" {
+		t.Fatalf("update: %d %v", w.Code, res)
+	}
+
+	for _, body := range []string{`{"total":100,"status":"open"}`, `{"total":300,"status":"open"}`, `{"total":200,"status":"paid"}`} {
+		w, res = routerTestServe(t, rt, http.MethodPost, "/api"+company+"/rtinvoice", body, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("create invoice: %d %v", w.Code, res)
+		}
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodPut, "/api"+company+"/rtinvoice/77", `{"total":50,"status":"paid"}`, nil)
+	if w.Code != http.StatusOK || routerTestData(res)["total"] != 50.0 {
+		t.Fatalf("put new: %d %v", w.Code, res)
+	}
+	w, res = routerTestServe(t, rt, http.MethodPut, "/api"+company+"/rtinvoice/77", `{"total":60}`, nil)
+	if w.Code != http.StatusOK || routerTestData(res)["total"] != 60.0 || routerTestData(res)["status"] != "" {
+		t.Fatalf("put existing: %d %v", w.Code, res)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodGet, "/api"+company+"/rtinvoice", "", map[string]string{
+		headerFilters: `[{"Field":"Status=","Value":"open"}]`,
+		headerSorters: "-Total",
+		headerCounter: "true",
+	})
+	resources, _ := res["resources"].([]interface{})
+	if w.Code != http.StatusOK || len(resources) != 2 || res["resourcesCount"] != 2.0 {
+		t.Fatalf("list: %d %v", w.Code, res)
+	}
+	if total := routerTestData(resources[0].(map[string]interface{}))["total"]; total != 300.0 {
+		t.Fatalf("list sorted %v first, want 300", total)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodGet, "/api"+company+"/rtinvoice", "", map[string]string{headerSize: "2"})
+	resources, _ = res["resources"].([]interface{})
+	next, _ := res["next"].(string)
+	if w.Code != http.StatusOK || len(resources) != 2 || next == "" {
+		t.Fatalf("first page: %d %v", w.Code, res)
+	}
+	w, res = routerTestServe(t, rt, http.MethodGet, "/api"+company+"/rtinvoice", "", map[string]string{headerSize: "2", headerNext: next})
+	resources, _ = res["resources"].([]interface{})
+	if w.Code != http.StatusOK || len(resources) != 2 {
+		t.Fatalf("second page: %d %v", w.Code, res)
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodDelete, "/api"+company+"/rtinvoice/77", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %v", w.Code, res)
+	}
+	w, res = routerTestServe(t, rt, http.MethodGet, "/api"+company+"/rtinvoice/77", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted: %d %v", w.Code, res)
+	}
+
+	w, _ = routerTestServe(t, rt, http.MethodGet, "/api/other", "", nil)
+	if w.Code == http.StatusOK {
+		t.Fatalf("unregistered kind: %d", w.Code)
+	}
+	w, _ = routerTestServe(t, rt, http.MethodPut, "/api/rtcompany", "", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("put on kind: %d", w.Code)
+	}
+}
@@ -0,0 +1,663 @@
+package aeio
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rules are row level security expressions, registered per kind and action, that must evaluate to true for the
+// action to be allowed. They are evaluated against the caller claims, the resource key path and the resource data.
+//
+// The language has:
+//   - references: claims.<name>, data.<Field> (go or json field name), key (the path), key.kind, key.id (or name), key.parent,
+//     principal.subject, principal.roles and principal.key, with any depth of maps and structs after them;
+//   - literals: 'strings' or "strings", numbers, true, false and null. Strings interpolate references in braces,
+//     as "/company/{claims.companyId}";
+//   - missing references, as claims the caller doesn't have, make every comparison false, except with null, as in
+//     claims.companyId != null. Data fields must be fields of the model, registered before the rule;
+//   - operators: == != < <= > >=, in (list membership), under (path is equal or a descendant), && || ! and parenthesis.
+//
+// Examples:
+//
+//	data.CustomerId == claims.userId || key under "/company/{claims.companyId}"
+//	"admin" in principal.roles
+//
+// Where the rules apply:
+//   - Get: ActionRead rules after loading the data;
+//   - GetMany and GetAny: ActionRead rules on each loaded item, hiding the ones that fail;
+//   - Create: ActionCreate rules on the data about to be saved;
+//   - Update: ActionUpdate rules on the stored data and on the data about to be saved;
+//   - Delete: ActionDelete rules on the stored data.
+//
+// All rules registered for a kind and action must be satisfied.
+type Rule struct {
+	Expression string
+	root       ruleNode
+}
+
+// RegisterRule parses and registers the rule expression for the action on the kind. It panics on invalid expressions,
+// as rules are registered on initialization.
+func RegisterRule(kind string, action string, expression string) {
+	DefaultRegistry.RegisterRule(kind, action, expression)
+}
+
+func (reg *Registry) RegisterRule(kind string, action string, expression string) {
+	ValidAction(action)
+	rule, err := ParseRule(expression)
+	if err != nil {
+		panic(fmt.Sprintf("aeio: invalid rule for %s %s: %v", kind, action, err))
+	}
+	// a misspelled data field would be always missing, so the rule would never match
+	for _, ref := range ruleReferences(rule.root) {
+		if ref.path[0] != "data" || len(ref.path) < 2 {
+			continue
+		}
+		model, ok := reg.models[kind]
+		if !ok {
+			panic("aeio: RegisterRule called with data fields for model " + kind + " that is not registered")
+		}
+		if !ruleHasField(reflect.TypeOf(model), ref.path[1]) {
+			panic(fmt.Sprintf("aeio: invalid rule for %s %s: %s is not a field of the model", kind, action, strings.Join(ref.path, ".")))
+		}
+	}
+	if reg.rules[kind] == nil {
+		reg.rules[kind] = make(map[string][]*Rule)
+	}
+	reg.rules[kind][action] = append(reg.rules[kind][action], rule)
+}
+
+// CheckRules evaluates the rules registered for the action on the resource kind. Actions already call it, so it is only
+// needed for custom operations.
+func (r *Resource) CheckRules(action string) error {
+	for _, rule := range r.App().Registry.rules[r.Key.Kind][action] {
+		ok, err := rule.Eval(r)
+		if err != nil {
+			return errorForbidden.withCause(err).withStack(10)
+		}
+		if !ok {
+			err = fmt.Errorf("rule not satisfied: %s", rule.Expression)
+			if r.Principal() == nil {
+				return errorUnauthorized.withCause(err).withStack(10)
+			}
+			return errorForbidden.withCause(err).withStack(10)
+		}
+	}
+	return nil
+}
+
+// checkActionRules checks the rules only for actions called directly, like authorizeAction. A denied resource drops
+// its data, which may be the stored one, so the error response doesn't carry it.
+func (r *Resource) checkActionRules(action string) error {
+	if len(r.ActionsStack) > 1 {
+		return nil
+	}
+	err := r.CheckRules(action)
+	if err != nil {
+		r.Data = nil
+	}
+	return err
+}
+
+// ParseRule parses a rule expression.
+func ParseRule(expression string) (*Rule, error) {
+	tokens, err := ruleTokens(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Rule{Expression: expression, root: root}, nil
+}
+
+// Eval evaluates the rule for the resource. Non boolean results are errors.
+func (rule *Rule) Eval(r *Resource) (bool, error) {
+	v, err := rule.root.eval(r)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("rule is not boolean: %s", rule.Expression)
+	}
+	return b, nil
+}
+
+// tokens
+
+const (
+	tokenIdent = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type ruleToken struct {
+	kind int
+	text string
+}
+
+func ruleTokens(s string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexRune(s[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, ruleToken{tokenString, s[i+1 : i+1+end]})
+			i += end + 2
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1]))):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{tokenNumber, s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{tokenIdent, s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, ruleToken{tokenOperator, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// parser
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek(texts ...string) string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	if t.kind != tokenOperator && t.kind != tokenIdent {
+		return ""
+	}
+	for _, text := range texts {
+		if t.text == text {
+			return text
+		}
+	}
+	return ""
+}
+
+func (p *ruleParser) or() (ruleNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||", "or") != "" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &ruleLogic{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) and() (ruleNode, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&", "and") != "" {
+		p.pos++
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &ruleLogic{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) not() (ruleNode, error) {
+	if p.peek("!", "not") != "" {
+		p.pos++
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleNot{n}, nil
+	}
+	return p.comparison()
+}
+
+func (p *ruleParser) comparison() (ruleNode, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek("==", "!=", "<", "<=", ">", ">=", "in", "under"); op != "" {
+		p.pos++
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleCompare{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *ruleParser) value() (ruleNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenString:
+		return parseRuleString(t.text)
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &ruleLiteral{f}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &ruleLiteral{true}, nil
+		case "false":
+			return &ruleLiteral{false}, nil
+		case "null":
+			return &ruleLiteral{nil}, nil
+		}
+		path := strings.Split(t.text, ".")
+		switch path[0] {
+		case "claims", "data", "key", "principal":
+		default:
+			return nil, fmt.Errorf("unknown reference %q", t.text)
+		}
+		return &ruleReference{path: path}, nil
+	}
+	if t.text == "(" {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek(")") == "" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// parseRuleString builds a literal or, if the string has {references}, a template.
+func parseRuleString(s string) (ruleNode, error) {
+	if !strings.Contains(s, "{") {
+		return &ruleLiteral{s}, nil
+	}
+	t := &ruleTemplate{}
+	for {
+		start := strings.Index(s, "{")
+		if start < 0 {
+			t.parts = append(t.parts, &ruleLiteral{s})
+			return t, nil
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return nil, errors.New("unterminated { in string")
+		}
+		ref, err := (&ruleParser{tokens: []ruleToken{{tokenIdent, s[start+1 : start+end]}}}).value()
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, &ruleLiteral{s[:start]}, ref)
+		s = s[start+end+1:]
+	}
+}
+
+// nodes
+
+type ruleNode interface {
+	eval(r *Resource) (interface{}, error)
+}
+
+type ruleLiteral struct {
+	value interface{}
+}
+
+func (n *ruleLiteral) eval(r *Resource) (interface{}, error) {
+	return n.value, nil
+}
+
+type ruleTemplate struct {
+	parts []ruleNode
+}
+
+func (n *ruleTemplate) eval(r *Resource) (interface{}, error) {
+	var b strings.Builder
+	for _, part := range n.parts {
+		v, err := part.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			// a missing reference must not match anything
+			return nil, nil
+		}
+		b.WriteString(ruleString(v))
+	}
+	return b.String(), nil
+}
+
+type ruleReference struct {
+	path []string
+}
+
+func (n *ruleReference) eval(r *Resource) (interface{}, error) {
+	var v interface{}
+	rest := n.path[1:]
+	switch n.path[0] {
+	case "claims":
+		if p := r.Principal(); p != nil {
+			v = p.Claims
+		}
+	case "data":
+		v = r.Data
+	case "principal":
+		p := r.Principal()
+		if p == nil || len(rest) == 0 {
+			return nil, nil
+		}
+		switch rest[0] {
+		case "subject":
+			v = p.Subject
+		case "roles":
+			v = p.Roles
+		case "key":
+			if p.Key != nil {
+				v = Path(p.Key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown reference %q", strings.Join(n.path, "."))
+		}
+		rest = rest[1:]
+	case "key":
+		if r.Key == nil {
+			return nil, nil
+		}
+		v = Path(r.Key)
+		if len(rest) > 0 {
+			switch rest[0] {
+			case "kind":
+				v = r.Key.Kind
+			case "id":
+				v = r.Key.ID
+				if r.Key.Name != "" {
+					v = r.Key.Name
+				}
+			case "parent":
+				v = nil
+				if r.Key.Parent != nil {
+					v = Path(r.Key.Parent)
+				}
+			default:
+				return nil, fmt.Errorf("unknown reference %q", strings.Join(n.path, "."))
+			}
+			rest = rest[1:]
+		}
+	}
+	for _, name := range rest {
+		v = ruleField(v, name)
+	}
+	return v, nil
+}
+
+// ruleField gets a map value or a struct field by go or json name.
+func ruleField(v interface{}, name string) interface{} {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		f := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !f.IsValid() {
+			return nil
+		}
+		return f.Interface()
+	case reflect.Struct:
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" {
+				continue
+			}
+			jsonName := strings.Split(sf.Tag.Get("json"), ",")[0]
+			if sf.Name == name || jsonName == name {
+				return rv.Field(i).Interface()
+			}
+		}
+	}
+	return nil
+}
+
+// ruleHasField checks if the model type has the field of ruleField. Models that are not structs may have any.
+func ruleHasField(t reflect.Type, name string) bool {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		jsonName := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if sf.Name == name || jsonName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleReferences lists the references used in the node and its children.
+func ruleReferences(n ruleNode) []*ruleReference {
+	switch n := n.(type) {
+	case *ruleReference:
+		return []*ruleReference{n}
+	case *ruleTemplate:
+		var refs []*ruleReference
+		for _, part := range n.parts {
+			refs = append(refs, ruleReferences(part)...)
+		}
+		return refs
+	case *ruleNot:
+		return ruleReferences(n.node)
+	case *ruleLogic:
+		return append(ruleReferences(n.left), ruleReferences(n.right)...)
+	case *ruleCompare:
+		return append(ruleReferences(n.left), ruleReferences(n.right)...)
+	}
+	return nil
+}
+
+type ruleNot struct {
+	node ruleNode
+}
+
+func (n *ruleNot) eval(r *Resource) (interface{}, error) {
+	v, err := n.node.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, errors.New("! on non boolean value")
+	}
+	return !b, nil
+}
+
+type ruleLogic struct {
+	op          string
+	left, right ruleNode
+}
+
+func (n *ruleLogic) eval(r *Resource) (interface{}, error) {
+	v, err := n.left.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	left, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s on non boolean value", n.op)
+	}
+	if (n.op == "||" && left) || (n.op == "&&" && !left) {
+		return left, nil
+	}
+	v, err = n.right.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	right, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s on non boolean value", n.op)
+	}
+	return right, nil
+}
+
+type ruleCompare struct {
+	op          string
+	left, right ruleNode
+}
+
+func (n *ruleCompare) eval(r *Resource) (interface{}, error) {
+	left, err := n.left.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// missing claims and fields never satisfy a comparison, so rules fail closed, but they can be tested with null
+	if left == nil || right == nil {
+		if !ruleIsNull(n.left) && !ruleIsNull(n.right) {
+			return false, nil
+		}
+		switch n.op {
+		case "==":
+			return left == nil && right == nil, nil
+		case "!=":
+			return left != nil || right != nil, nil
+		}
+		return false, nil
+	}
+
+	switch n.op {
+	case "==":
+		return ruleEqual(left, right), nil
+	case "!=":
+		return !ruleEqual(left, right), nil
+	case "in":
+		rv := reflect.ValueOf(right)
+		if right == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+			return false, nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if ruleEqual(left, rv.Index(i).Interface()) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "under":
+		l, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok || rs == "" {
+			return false, nil
+		}
+		rs = strings.TrimRight(rs, "/")
+		return l == rs || strings.HasPrefix(l, rs+"/"), nil
+	}
+
+	// ordering
+	c, ok := compareValues(left, right)
+	if !ok {
+		return false, nil
+	}
+	return matchOperator(n.op, c), nil
+}
+
+// ruleIsNull checks if the node is the null literal.
+func ruleIsNull(n ruleNode) bool {
+	l, ok := n.(*ruleLiteral)
+	return ok && l.value == nil
+}
+
+// ruleEqual compares values, with numbers compared by value and numbers against strings compared by their text,
+// as ids may come as numbers in keys and as strings in claims. Missing values are equal to nothing.
+func ruleEqual(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	_, an := numberValue(a)
+	_, bn := numberValue(b)
+	_, as := a.(string)
+	_, bs := b.(string)
+	if (an && bs) || (as && bn) {
+		return ruleString(a) == ruleString(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func ruleString(v interface{}) string {
+	if f, ok := numberValue(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,233 @@
+package aeio
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+type rulesTestInvoice struct {
+	CustomerId string   `json:"customerId"`
+	Total      int64    `json:"total"`
+	Tags       []string `json:"tags"`
+	Owner      *datastore.Key
+}
+
+// rulesTestAuthenticator makes the caller the user of the X-Test-User header, if any, with a userId claim.
+type rulesTestAuthenticator struct{}
+
+func (rulesTestAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	user := request.Header.Get("X-Test-User")
+	if user == "" {
+		return nil, nil
+	}
+	return &Principal{Subject: user, Claims: map[string]interface{}{"userId": user}}, nil
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{`data.customerId == claims.userId`, true},
+		{`data.Total >= 10 && data.Total < 100.5`, true},
+		{`!(data.customerId in claims.customers) || key.kind == "rinvoice"`, true},
+		{`not data.Total > 1 and key under '/rcompany/{claims.companyId}' or false`, true},
+		{`"admin" in principal.roles`, true},
+		{`claims.companyId != null`, true},
+		{`data.Total == -1`, true},
+
+		{``, false},
+		{`data.customerId ==`, false},
+		{`(data.Total > 1`, false},
+		{`data.Total > 1)`, false},
+		{`other.field == 1`, false},
+		{`data.customerId == "unterminated`, false},
+		{`key under "/rcompany/{claims.companyId"`, false},
+		{`data.Total # 1`, false},
+		{`data.Total 1`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := ParseRule(tt.expression)
+			if tt.valid && err != nil {
+				t.Fatalf("expected valid rule, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestRuleEval(t *testing.T) {
+	company := datastore.IDKey("rcompany", 5, nil)
+	r := &Resource{
+		Key:  datastore.IDKey("rinvoice", 9, company),
+		Data: &rulesTestInvoice{CustomerId: "7", Total: 50, Tags: []string{"urgent"}},
+		Access: &Access{Principal: &Principal{
+			Subject: "u7",
+			Roles:   []string{"clerk"},
+			Claims:  map[string]interface{}{"userId": 7.0, "companyId": "5", "customers": []interface{}{"7", "8"}, "flag": true},
+		}},
+	}
+	anonymous := &Resource{Key: r.Key, Data: r.Data, Access: &Access{}}
+
+	tests := []struct {
+		expression string
+		resource   *Resource
+		want       bool
+		err        bool
+	}{
+		{`data.customerId == claims.userId`, r, true, false},
+		{`data.CustomerId == "7"`, r, true, false},
+		{`data.customerId != claims.userId`, r, false, false},
+		{`data.total > 10 && data.total <= 50`, r, true, false},
+		{`data.total < 10 || data.total >= 51`, r, false, false},
+		{`data.customerId in claims.customers`, r, true, false},
+		{`"urgent" in data.tags`, r, true, false},
+		{`"clerk" in principal.roles`, r, true, false},
+		{`principal.subject == "u7"`, r, true, false},
+		{`key == "/rcompany/5/rinvoice/9"`, r, true, false},
+		{`key.kind == "rinvoice" && key.id == 9 && key.parent == "/rcompany/5"`, r, true, false},
+		{`key under "/rcompany/{claims.companyId}"`, r, true, false},
+		{`key under "/rcompany/6"`, r, false, false},
+		{`claims.flag && !(data.total == 1)`, r, true, false},
+
+		// missing claims and fields fail closed, whatever the operator, but can be tested against null
+		{`claims.missing == data.Owner`, r, false, false},
+		{`claims.missing == claims.other`, r, false, false},
+		{`claims.missing != data.customerId`, r, false, false},
+		{`claims.missing < data.total`, r, false, false},
+		{`claims.missing in data.tags`, r, false, false},
+		{`key under "/rcompany/{claims.missing}"`, r, false, false},
+		{`claims.missing == null`, r, true, false},
+		{`claims.userId != null`, r, true, false},
+		{`claims.userId == null`, r, false, false},
+		{`null == null`, r, true, false},
+		{`data.customerId == claims.userId`, anonymous, false, false},
+		{`principal.subject == null`, anonymous, true, false},
+
+		{`data.total`, r, false, true},
+		{`!data.total`, r, false, true},
+		{`data.total && true`, r, false, true},
+		{`principal.other == 1`, r, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			rule, err := ParseRule(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := rule.Eval(tt.resource)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterRuleUnknownField(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterModel("rinvoice", rulesTestInvoice{})
+
+	tests := []struct {
+		name       string
+		kind       string
+		expression string
+		panics     bool
+	}{
+		{"json name", "rinvoice", `data.customerId == claims.userId`, false},
+		{"go name", "rinvoice", `data.CustomerId == claims.userId`, false},
+		{"no data", "rother", `claims.userId != null`, false},
+		{"misspelled", "rinvoice", `data.customer == claims.userId`, true},
+		{"in template", "rinvoice", `key under "/rcompany/{data.company}"`, true},
+		{"model not registered", "rother", `data.customerId == claims.userId`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Fatalf("panicked with %v, want panic %v", r, tt.panics)
+				}
+			}()
+			reg.RegisterRule(tt.kind, ActionRead, tt.expression)
+		})
+	}
+}
+
+// TestRulesDeniedResponses checks that the responses of actions denied by rules on the stored data don't carry it.
+func TestRulesDeniedResponses(t *testing.T) {
+	reg := NewRegistry()
+	reg.RegisterModel("rcompany", routerTestCompany{})
+	reg.RegisterModel("rinvoice", rulesTestInvoice{})
+	reg.RegisterChild("", "rcompany")
+	reg.RegisterChild("rcompany", "rinvoice")
+	for _, action := range []string{ActionRead, ActionUpdate, ActionDelete} {
+		reg.RegisterRule("rinvoice", action, `data.customerId == claims.userId`)
+	}
+	app, err := New(Config{Store: NewMemoryStore(), Registry: reg, DisableFirebase: true, Authenticator: rulesTestAuthenticator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	rt := app.NewRouter("")
+
+	owner := map[string]string{"X-Test-User": "7"}
+	w, res := routerTestServe(t, rt, http.MethodPost, "/rcompany/1/rinvoice", `{"customerId":"7","total":10}`, owner)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %v", w.Code, res)
+	}
+	invoice, _ := res["key"].(string)
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header map[string]string
+		code   int
+	}{
+		{"get by other", http.MethodGet, "", map[string]string{"X-Test-User": "8"}, http.StatusForbidden},
+		{"get anonymous", http.MethodGet, "", nil, http.StatusUnauthorized},
+		{"update by other", http.MethodPatch, `{"total":20}`, map[string]string{"X-Test-User": "8"}, http.StatusForbidden},
+		{"update taking over", http.MethodPatch, `{"customerId":"8"}`, owner, http.StatusForbidden},
+		{"put by other", http.MethodPut, `{"customerId":"8"}`, map[string]string{"X-Test-User": "8"}, http.StatusForbidden},
+		{"conditional update by other", http.MethodPatch, `{"total":20}`, map[string]string{"X-Test-User": "8", "If-Match": `"0"`}, http.StatusForbidden},
+		{"delete by other", http.MethodDelete, "", map[string]string{"X-Test-User": "8"}, http.StatusForbidden},
+		{"get missing", http.MethodGet, "", owner, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := invoice
+			if tt.code == http.StatusNotFound {
+				path = "/rcompany/1/rinvoice/999"
+			}
+			w, res := routerTestServe(t, rt, tt.method, path, tt.body, tt.header)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, res)
+			}
+			if _, ok := res["data"]; ok {
+				t.Fatalf("denied response has data: %v", res)
+			}
+		})
+	}
+
+	w, res = routerTestServe(t, rt, http.MethodGet, invoice, "", owner)
+	if w.Code != http.StatusOK || routerTestData(res)["customerId"] != "7" || routerTestData(res)["total"] != 10.0 {
+		t.Fatalf("the denied actions changed the invoice: %d %v", w.Code, res)
+	}
+}
@@ -0,0 +1,222 @@
+package aeio
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Store is the storage backend used by all resource actions. The datastore client is the default implementation,
+// but anything that honors hierarchical keys and the queries described by Query may be used.
+// Keys are always *datastore.Key, as the whole package relies on them for paths and paternity.
+type Store interface {
+	// Get loads the entity stored for key into dst. It must return datastore.ErrNoSuchEntity if there is none.
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	// GetMulti is a batch version of Get. dst must be a slice of the same length of keys.
+	// Missing entities are reported as datastore.ErrNoSuchEntity inside a datastore.MultiError.
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	// Put saves src under key, returning the complete key if an incomplete one was passed.
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	// Delete removes the entity stored for key.
+	Delete(ctx context.Context, key *datastore.Key) error
+	// PutMulti is a batch version of Put. src must be a slice of the same length of keys, and errors of single
+	// entities are reported inside a datastore.MultiError. Callers keep to MultiSizeMax entities per call.
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	// DeleteMulti is a batch version of Delete.
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	// AllocateIDs completes the incomplete keys with ids that Put will never assign by itself.
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+	// Run executes the query, returning an iterator over the results.
+	Run(ctx context.Context, q *Query) Iterator
+	// Count returns the number of results for the query.
+	Count(ctx context.Context, q *Query) (int, error)
+	// Transaction runs f inside a transaction. If f returns an error, nothing is committed.
+	// Contention must be reported as datastore.ErrConcurrentTransaction, without retrying, see App.RunInTransaction.
+	Transaction(ctx context.Context, f func(tx Transaction) error) error
+}
+
+// Iterator is the result of a query run. Next returns iterator.Done when there are no more results.
+type Iterator interface {
+	Next(dst interface{}) (*datastore.Key, error)
+	Cursor() (string, error)
+}
+
+// Transaction holds the operations allowed inside Store.Transaction.
+type Transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Delete(key *datastore.Key) error
+}
+
+// MultiSizeMax is the most entities a single multi operation takes in datastore. Bigger ones are split in chunks.
+const MultiSizeMax = 500
+
+// ErrInvalidCursor is returned (wrapped) by iterators when the query start cursor can't be decoded by the store.
+var ErrInvalidCursor = errors.New("aeio: invalid cursor")
+
+// ErrScanLimit is returned (wrapped) by iterators and counts of stores that apply filters out of the backend, when
+// they read more rows than they allow to find the results. See DatastoreStore.ScanMax.
+var ErrScanLimit = errors.New("aeio: query scanned too many rows")
+
+// DefaultStore is the store of the default App. If set before the default App is initialized, it is used instead of
+// connecting to datastore, e.g. a MemoryStore for tests. Otherwise it is set to the DatastoreClient store.
+var DefaultStore Store
+
+// QueryFilter is one condition of a query. Op is one of "=", "!=", "<", "<=", ">", ">=", "in" or "not-in". The value
+// of "in" and "not-in" is a []interface{} with the values.
+type QueryFilter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// QueryOrder is one sort order of a query.
+type QueryOrder struct {
+	Field string
+	Desc  bool
+}
+
+// Query is a store independent description of a datastore like query. Build it with NewQuery and the chained methods,
+// the same way as datastore.NewQuery. Each method returns a modified copy.
+type Query struct {
+	Kind        string
+	AncestorKey *datastore.Key
+	Filters     []QueryFilter
+	Orders      []QueryOrder
+	LimitSize   int
+	StartCursor string
+	OnlyKeys    bool
+	Projection  []string
+
+	err error
+}
+
+// NewQuery creates a new query for the kind.
+func NewQuery(kind string) *Query {
+	return &Query{Kind: kind}
+}
+
+func (q *Query) clone() *Query {
+	c := *q
+	c.Filters = append([]QueryFilter(nil), q.Filters...)
+	c.Orders = append([]QueryOrder(nil), q.Orders...)
+	c.Projection = append([]string(nil), q.Projection...)
+	return &c
+}
+
+// Err returns the first error found while building the query.
+func (q *Query) Err() error {
+	return q.err
+}
+
+// Ancestor restricts the query to descendants of the key.
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q = q.clone()
+	if ancestor == nil {
+		q.err = errors.New("aeio: nil query ancestor")
+		return q
+	}
+	q.AncestorKey = ancestor
+	return q
+}
+
+// Filter adds a field based filter in the datastore format "Field op", e.g. "Age >=". The special field __key__
+// filters by the entity key. The "in" and "not-in" operators take a slice of values, e.g. "Status in".
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	field := strings.TrimRight(filterStr, " ><=!")
+	op := strings.TrimSpace(filterStr[len(field):])
+	for _, listOp := range []string{"not-in", "in"} {
+		if strings.HasSuffix(strings.ToLower(filterStr), " "+listOp) {
+			field, op = strings.TrimSpace(filterStr[:len(filterStr)-len(listOp)]), listOp
+			break
+		}
+	}
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+	case "in", "not-in":
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 || v.Len() == 0 {
+			q.err = errors.New("aeio: query filter " + filterStr + " needs a non empty slice of values")
+			return q
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = v.Index(i).Interface()
+		}
+		value = values
+	default:
+		q.err = errors.New("aeio: invalid query filter operator: " + filterStr)
+		return q
+	}
+	if field == "" {
+		q.err = errors.New("aeio: invalid query filter: " + filterStr)
+		return q
+	}
+	q.Filters = append(q.Filters, QueryFilter{Field: field, Op: op, Value: value})
+	return q
+}
+
+// Order adds a sort order. Prefix the field name with "-" for descending order.
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	o := QueryOrder{Field: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o.Field = strings.TrimSpace(fieldName[1:])
+		o.Desc = true
+	}
+	if o.Field == "" {
+		q.err = errors.New("aeio: empty query order")
+		return q
+	}
+	q.Orders = append(q.Orders, o)
+	return q
+}
+
+// Limit sets the maximum number of results. Zero means no limit.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.LimitSize = limit
+	return q
+}
+
+// Start sets the cursor from where the results start.
+func (q *Query) Start(cursor string) *Query {
+	q = q.clone()
+	q.StartCursor = cursor
+	return q
+}
+
+// Project makes the query return only the properties, which must be indexed. Entities missing any of them are not
+// returned, like by datastore. Unlike datastore.Query.Project, it replaces the projection, so no names clear it.
+func (q *Query) Project(fieldNames ...string) *Query {
+	q = q.clone()
+	q.Projection = append([]string(nil), fieldNames...)
+	return q
+}
+
+// KeysOnly makes the query return only keys, without loading entities.
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.OnlyKeys = true
+	return q
+}
+
+// errorIterator is returned by stores when the query can't even start.
+type errorIterator struct {
+	err error
+}
+
+func (i *errorIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, i.err
+}
+
+func (i *errorIterator) Cursor() (string, error) {
+	return "", i.err
+}
@@ -0,0 +1,254 @@
+package aeio
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultScanMax is the default of DatastoreStore.ScanMax.
+const DefaultScanMax = 5000
+
+// DatastoreStore is the Store backed by a Cloud Datastore client.
+type DatastoreStore struct {
+	Client *datastore.Client
+	// ScanMax limits the rows read by queries and counts with filters datastore can't apply ("!=", "in" and
+	// "not-in"), so a sparse filter can't read a whole kind. Past it they fail with ErrScanLimit. Zero uses
+	// DefaultScanMax.
+	ScanMax int
+}
+
+// NewDatastoreStore wraps the datastore client in a Store.
+func NewDatastoreStore(client *datastore.Client) *DatastoreStore {
+	return &DatastoreStore{Client: client}
+}
+
+func (s *DatastoreStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return s.Client.Get(ctx, key, dst)
+}
+
+func (s *DatastoreStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return s.Client.GetMulti(ctx, keys, dst)
+}
+
+func (s *DatastoreStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return s.Client.Put(ctx, key, src)
+}
+
+func (s *DatastoreStore) Delete(ctx context.Context, key *datastore.Key) error {
+	return s.Client.Delete(ctx, key)
+}
+
+func (s *DatastoreStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return s.Client.PutMulti(ctx, keys, src)
+}
+
+func (s *DatastoreStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return s.Client.DeleteMulti(ctx, keys)
+}
+
+func (s *DatastoreStore) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return s.Client.AllocateIDs(ctx, keys)
+}
+
+func (s *DatastoreStore) Run(ctx context.Context, q *Query) Iterator {
+	dq, residual, err := datastoreQuery(q, s.scanMax())
+	if err != nil {
+		return &errorIterator{err: err}
+	}
+	ite := &datastoreIterator{ite: s.Client.Run(ctx, dq)}
+	if len(residual) > 0 {
+		return &filteredIterator{ite: ite, filters: residual, limit: q.LimitSize, keysOnly: q.OnlyKeys, scanMax: s.scanMax()}
+	}
+	return ite
+}
+
+func (s *DatastoreStore) Count(ctx context.Context, q *Query) (int, error) {
+	dq, residual, err := datastoreQuery(q, s.scanMax())
+	if err != nil {
+		return 0, err
+	}
+	if len(residual) == 0 {
+		return s.Client.Count(ctx, dq)
+	}
+	ite := &filteredIterator{ite: &datastoreIterator{ite: s.Client.Run(ctx, dq)}, filters: residual, keysOnly: true, scanMax: s.scanMax()}
+	n := 0
+	for {
+		_, err := ite.Next(nil)
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (s *DatastoreStore) scanMax() int {
+	if s.ScanMax <= 0 {
+		return DefaultScanMax
+	}
+	return s.ScanMax
+}
+
+func (s *DatastoreStore) Transaction(ctx context.Context, f func(tx Transaction) error) error {
+	// retries are done by App.RunInTransaction, the same way for every store
+	_, err := s.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&datastoreTransaction{ctx: ctx, client: s.Client, tx: tx})
+	}, datastore.MaxAttempts(1))
+	return err
+}
+
+// datastoreQuery translates the Query to the datastore equivalent. The datastore client only filters with "=", "<",
+// "<=", ">" and ">=", so the other filters are returned to be applied on the results, see filteredIterator. Then the
+// limit and keys only are left to the iterator too, as it needs the properties and may drop rows, and datastore reads
+// one row past scanMax, so the iterator knows when it is reached.
+func datastoreQuery(q *Query, scanMax int) (*datastore.Query, []QueryFilter, error) {
+	if q.Err() != nil {
+		return nil, nil, q.Err()
+	}
+
+	dq := datastore.NewQuery(q.Kind)
+	if q.AncestorKey != nil {
+		dq = dq.Ancestor(q.AncestorKey)
+	}
+	var residual []QueryFilter
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "!=", "in", "not-in":
+			residual = append(residual, f)
+		default:
+			dq = dq.Filter(f.Field+" "+f.Op, f.Value)
+		}
+	}
+	for _, o := range q.Orders {
+		if o.Desc {
+			dq = dq.Order("-" + o.Field)
+		} else {
+			dq = dq.Order(o.Field)
+		}
+	}
+	if len(residual) > 0 {
+		dq = dq.Limit(scanMax + 1)
+	} else if q.LimitSize > 0 {
+		dq = dq.Limit(q.LimitSize)
+	}
+	if q.StartCursor != "" {
+		cursor, err := datastore.DecodeCursor(q.StartCursor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+		dq = dq.Start(cursor)
+	}
+	if q.OnlyKeys && len(residual) == 0 {
+		dq = dq.KeysOnly()
+	}
+	if len(q.Projection) > 0 {
+		dq = dq.Project(q.Projection...)
+	}
+	return dq, residual, nil
+}
+
+type datastoreIterator struct {
+	ite *datastore.Iterator
+}
+
+func (i *datastoreIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return i.ite.Next(dst)
+}
+
+func (i *datastoreIterator) Cursor() (string, error) {
+	cursor, err := i.ite.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return cursor.String(), nil
+}
+
+// filteredIterator applies the filters datastore can't to the results of a query, up to limit results if not zero.
+// It stops reading right after the last result, so the cursor is still the one after it. Rows are read until
+// enough of them match, but no more than scanMax, so sparse filters are better narrowed with other filters.
+type filteredIterator struct {
+	ite      Iterator
+	filters  []QueryFilter
+	limit    int
+	keysOnly bool
+	n        int
+	scanMax  int
+	scanned  int
+}
+
+func (i *filteredIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if i.limit > 0 && i.n >= i.limit {
+		return nil, iterator.Done
+	}
+	for {
+		var props datastore.PropertyList
+		key, err := i.ite.Next(&props)
+		if err != nil {
+			return key, err
+		}
+		i.scanned++
+		if i.scanMax > 0 && i.scanned > i.scanMax {
+			return nil, fmt.Errorf("%w: more than %d rows read to apply the filters", ErrScanLimit, i.scanMax)
+		}
+		e := &memoryEntity{key: key, props: props}
+		matched := true
+		for _, f := range i.filters {
+			if !matchFilter(f, propertyValues(e, f.Field)) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		i.n++
+		if i.keysOnly || dst == nil {
+			return key, nil
+		}
+		return key, loadEntity(dst, props)
+	}
+}
+
+func (i *filteredIterator) Cursor() (string, error) {
+	return i.ite.Cursor()
+}
+
+// datastoreTransaction resolves incomplete keys before putting, so callers get the complete key immediately
+// instead of a pending key that is only valid after commit.
+type datastoreTransaction struct {
+	ctx    context.Context
+	client *datastore.Client
+	tx     *datastore.Transaction
+}
+
+func (t *datastoreTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *datastoreTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return t.tx.GetMulti(keys, dst)
+}
+
+func (t *datastoreTransaction) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if key.Incomplete() {
+		keys, err := t.client.AllocateIDs(t.ctx, []*datastore.Key{key})
+		if err != nil {
+			return nil, err
+		}
+		key = keys[0]
+	}
+	_, err := t.tx.Put(key, src)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (t *datastoreTransaction) Delete(key *datastore.Key) error {
+	return t.tx.Delete(key)
+}
@@ -0,0 +1,671 @@
+package aeio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It is meant for tests and local development, so a full
+// request cycle can run without a datastore emulator. It honors hierarchical keys, ancestor queries, filters on any
+// saved property (including the injected Parent and the special __key__), orders, limits, cursors and counts.
+// Transactions are serialized and don't support nesting. Like in datastore, a transaction whose read entities were
+// written meanwhile, by writes out of transactions, fails on commit with datastore.ErrConcurrentTransaction.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	txMu     sync.Mutex
+	entities map[string]*memoryEntity
+	// versions counts the writes of each key, including deletes, so transactions detect the ones after their reads.
+	versions map[string]int64
+	lastID   int64
+}
+
+type memoryEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entities: make(map[string]*memoryEntity), versions: make(map[string]int64)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.get(key, dst)
+}
+
+func (s *MemoryStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getMulti(keys, dst, s.get)
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key, e, err := s.entity(key, src)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.entities[key.Encode()] = e
+	s.versions[key.Encode()]++
+	s.mu.Unlock()
+	return key, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key *datastore.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	s.mu.Lock()
+	delete(s.entities, key.Encode())
+	s.versions[key.Encode()]++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("aeio: src must be a slice with the same length of keys")
+	}
+
+	complete := make([]*datastore.Key, len(keys))
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		item := v.Index(i)
+		if item.Kind() != reflect.Ptr && item.Kind() != reflect.Interface {
+			item = item.Addr()
+		}
+		complete[i], errs[i] = s.Put(ctx, key, item.Interface())
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return complete, errs
+	}
+	return complete, nil
+}
+
+func (s *MemoryStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = s.Delete(ctx, key)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s *MemoryStore) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	allocated := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		if key == nil || !key.Incomplete() {
+			return nil, datastore.ErrInvalidKey
+		}
+		allocated[i] = s.allocate(key)
+	}
+	return allocated, nil
+}
+
+func (s *MemoryStore) Run(ctx context.Context, q *Query) Iterator {
+	if err := ctx.Err(); err != nil {
+		return &errorIterator{err: err}
+	}
+	results, offset, err := s.run(q)
+	if err != nil {
+		return &errorIterator{err: err}
+	}
+	return &memoryIterator{results: results, offset: offset, keysOnly: q.OnlyKeys, projection: q.Projection}
+}
+
+func (s *MemoryStore) Count(ctx context.Context, q *Query) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	results, _, err := s.run(q)
+	if err != nil {
+		return 0, err
+	}
+	return len(results), nil
+}
+
+func (s *MemoryStore) Transaction(ctx context.Context, f func(tx Transaction) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := &memoryTransaction{
+		store:   s,
+		reads:   make(map[string]int64),
+		puts:    make(map[string]*memoryEntity),
+		deletes: make(map[string]struct{}),
+	}
+	err := f(tx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, version := range tx.reads {
+		if s.versions[k] != version {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+	for k := range tx.deletes {
+		delete(s.entities, k)
+		s.versions[k]++
+	}
+	for k, e := range tx.puts {
+		s.entities[k] = e
+		s.versions[k]++
+	}
+	return nil
+}
+
+func (s *MemoryStore) get(key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	s.mu.RLock()
+	e, ok := s.entities[key.Encode()]
+	s.mu.RUnlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadEntity(dst, e.props)
+}
+
+// entity builds the entity to be stored, completing the key if needed.
+func (s *MemoryStore) entity(key *datastore.Key, src interface{}) (*datastore.Key, *memoryEntity, error) {
+	if key == nil {
+		return nil, nil, datastore.ErrInvalidKey
+	}
+	props, err := saveEntity(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.Incomplete() {
+		key = s.allocate(key)
+	}
+	return key, &memoryEntity{key: key, props: props}, nil
+}
+
+// allocate completes the key with the next id, skipping ids already taken by client supplied keys.
+func (s *MemoryStore) allocate(key *datastore.Key) *datastore.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.lastID++
+		k := datastore.IDKey(key.Kind, s.lastID, key.Parent)
+		k.Namespace = key.Namespace
+		if _, ok := s.entities[k.Encode()]; !ok {
+			return k
+		}
+	}
+}
+
+// run returns the query results after applying the start cursor and limit, and the offset of the first result.
+func (s *MemoryStore) run(q *Query) ([]*memoryEntity, int, error) {
+	if q.Err() != nil {
+		return nil, 0, q.Err()
+	}
+
+	offset := 0
+	if q.StartCursor != "" {
+		var err error
+		offset, err = strconv.Atoi(q.StartCursor)
+		if err != nil || offset < 0 {
+			return nil, 0, fmt.Errorf("%w: %s", ErrInvalidCursor, q.StartCursor)
+		}
+	}
+
+	var results []*memoryEntity
+	s.mu.RLock()
+	for _, e := range s.entities {
+		if matchQuery(q, e) {
+			results = append(results, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, o := range q.Orders {
+			c, _ := compareValues(propertyValues(results[i], o.Field)[0], propertyValues(results[j], o.Field)[0])
+			if c == 0 {
+				continue
+			}
+			if o.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return compareKeys(results[i].key, results[j].key) < 0
+	})
+
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if q.LimitSize > 0 && len(results) > q.LimitSize {
+		results = results[:q.LimitSize]
+	}
+	return results, offset, nil
+}
+
+// matchQuery checks the kind, ancestor and filters of the query against the entity.
+// Like datastore, entities missing a filtered or sorted property are not matched.
+func matchQuery(q *Query, e *memoryEntity) bool {
+	if q.Kind != "" && e.key.Kind != q.Kind {
+		return false
+	}
+	if q.AncestorKey != nil && !hasAncestor(e.key, q.AncestorKey) {
+		return false
+	}
+	for _, o := range q.Orders {
+		if len(propertyValues(e, o.Field)) == 0 {
+			return false
+		}
+	}
+	for _, name := range q.Projection {
+		if len(propertyValues(e, name)) == 0 {
+			return false
+		}
+	}
+	for _, f := range q.Filters {
+		if !matchFilter(f, propertyValues(e, f.Field)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFilter checks the values of a property against the filter. Like datastore, multi valued properties match if
+// any of the values does, and missing properties never match, not even "!=" and "not-in".
+func matchFilter(f QueryFilter, values []interface{}) bool {
+	for _, v := range values {
+		switch f.Op {
+		case "in", "not-in":
+			in := false
+			for _, fv := range f.Value.([]interface{}) {
+				if c, ok := compareValues(v, fv); ok && c == 0 {
+					in = true
+					break
+				}
+			}
+			if in == (f.Op == "in") {
+				return true
+			}
+		case "!=":
+			// values of other types are different
+			if c, ok := compareValues(v, f.Value); !ok || c != 0 {
+				return true
+			}
+		default:
+			if c, ok := compareValues(v, f.Value); ok && matchOperator(f.Op, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchOperator(op string, c int) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// hasAncestor checks if ancestor is the key itself or one of its parents.
+func hasAncestor(k *datastore.Key, ancestor *datastore.Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyValues returns all values of the named property, expanding multi valued properties.
+func propertyValues(e *memoryEntity, name string) []interface{} {
+	if name == "__key__" {
+		return []interface{}{e.key}
+	}
+	var values []interface{}
+	for _, p := range e.props {
+		if p.Name != name {
+			continue
+		}
+		if list, ok := p.Value.([]interface{}); ok {
+			values = append(values, list...)
+			continue
+		}
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+// compareValues orders two property values. It returns false if they are not comparable.
+// Numbers are compared by value independently of being integers or floats, as json filters are always floats.
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+
+	if af, ok := numberValue(a); ok {
+		bf, ok := numberValue(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av == bv:
+			return 0, true
+		case bv:
+			return -1, true
+		}
+		return 1, true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	case *datastore.Key:
+		bv, ok := b.(*datastore.Key)
+		if !ok || av == nil || bv == nil {
+			return 0, ok && av == bv
+		}
+		return compareKeys(av, bv), true
+	case []byte:
+		bv, ok := b.([]byte)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compareKeys orders keys like datastore: by path from the root, numeric ids before names.
+func compareKeys(a *datastore.Key, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ka, kb := pa[i], pb[i]
+		switch {
+		case ka.Kind < kb.Kind:
+			return -1
+		case ka.Kind > kb.Kind:
+			return 1
+		case ka.Name == "" && kb.Name != "":
+			return -1
+		case ka.Name != "" && kb.Name == "":
+			return 1
+		case ka.ID < kb.ID:
+			return -1
+		case ka.ID > kb.ID:
+			return 1
+		case ka.Name < kb.Name:
+			return -1
+		case ka.Name > kb.Name:
+			return 1
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// keyPath returns the key chain starting from the root.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+func saveEntity(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(src)
+}
+
+func loadEntity(dst interface{}, props []datastore.Property) error {
+	// loaders may keep or change the slice, so they always receive a copy
+	props = append([]datastore.Property(nil), props...)
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// getMulti implements GetMulti on top of a single get function, following the datastore conventions on dst slices.
+func getMulti(keys []*datastore.Key, dst interface{}, get func(*datastore.Key, interface{}) error) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return errors.New("aeio: dst must be a slice with the same length of keys")
+	}
+
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		elem := v.Index(i)
+		var d interface{}
+		switch elem.Kind() {
+		case reflect.Ptr:
+			if elem.IsNil() {
+				elem.Set(reflect.New(elem.Type().Elem()))
+			}
+			d = elem.Interface()
+		case reflect.Interface:
+			d = elem.Interface()
+		default:
+			d = elem.Addr().Interface()
+		}
+		errs[i] = get(k, d)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+type memoryIterator struct {
+	results    []*memoryEntity
+	offset     int
+	pos        int
+	keysOnly   bool
+	projection []string
+}
+
+func (i *memoryIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if i.pos >= len(i.results) {
+		return nil, iterator.Done
+	}
+	e := i.results[i.pos]
+	i.pos++
+	if !i.keysOnly && dst != nil {
+		props := e.props
+		if len(i.projection) > 0 {
+			props = projectProperties(e.props, i.projection)
+		}
+		err := loadEntity(dst, props)
+		if err != nil {
+			return e.key, err
+		}
+	}
+	return e.key, nil
+}
+
+// projectProperties keeps only the named properties.
+func projectProperties(props []datastore.Property, names []string) []datastore.Property {
+	projected := make([]datastore.Property, 0, len(names))
+	for _, p := range props {
+		for _, name := range names {
+			if p.Name == name {
+				projected = append(projected, p)
+				break
+			}
+		}
+	}
+	return projected
+}
+
+func (i *memoryIterator) Cursor() (string, error) {
+	return strconv.Itoa(i.offset + i.pos), nil
+}
+
+// memoryTransaction buffers writes until the transaction function returns without error.
+// Reads see the writes already made inside the transaction, and keep the version of the keys read from the store.
+type memoryTransaction struct {
+	store   *MemoryStore
+	reads   map[string]int64
+	puts    map[string]*memoryEntity
+	deletes map[string]struct{}
+}
+
+func (t *memoryTransaction) Get(key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	k := key.Encode()
+	if _, ok := t.deletes[k]; ok {
+		return datastore.ErrNoSuchEntity
+	}
+	if e, ok := t.puts[k]; ok {
+		return loadEntity(dst, e.props)
+	}
+	if _, ok := t.reads[k]; !ok {
+		t.store.mu.RLock()
+		t.reads[k] = t.store.versions[k]
+		t.store.mu.RUnlock()
+	}
+	return t.store.get(key, dst)
+}
+
+func (t *memoryTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return getMulti(keys, dst, t.Get)
+}
+
+func (t *memoryTransaction) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key, e, err := t.store.entity(key, src)
+	if err != nil {
+		return nil, err
+	}
+	k := key.Encode()
+	delete(t.deletes, k)
+	t.puts[k] = e
+	return key, nil
+}
+
+func (t *memoryTransaction) Delete(key *datastore.Key) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	k := key.Encode()
+	delete(t.puts, k)
+	t.deletes[k] = struct{}{}
+	return nil
+}
@@ -0,0 +1,410 @@
+package aeio
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+type memoryTestEntity struct {
+	Name string
+	Rank int64
+	Tags []string
+}
+
+// newMemoryTestStore returns a store with two parents, holding three and one children, and the keys of the children.
+func newMemoryTestStore(t *testing.T) (*MemoryStore, []*datastore.Key) {
+	t.Helper()
+	s := NewMemoryStore()
+	ctx := context.Background()
+	acme := datastore.IDKey("memparent", 1, nil)
+	other := datastore.IDKey("memparent", 2, nil)
+	entities := []struct {
+		parent *datastore.Key
+		data   memoryTestEntity
+	}{
+		{acme, memoryTestEntity{Name: "a", Rank: 3, Tags: []string{"red", "blue"}}},
+		{acme, memoryTestEntity{Name: "b", Rank: 1, Tags: []string{"blue"}}},
+		{acme, memoryTestEntity{Name: "c", Rank: 2, Tags: []string{"green"}}},
+		{other, memoryTestEntity{Name: "d", Rank: 4, Tags: []string{"red"}}},
+	}
+	keys := make([]*datastore.Key, len(entities))
+	for i, e := range entities {
+		data := e.data
+		k, err := s.Put(ctx, datastore.IncompleteKey("memchild", e.parent), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+	}
+	return s, keys
+}
+
+// memoryTestNames runs the query and returns the names found, in order.
+func memoryTestNames(t *testing.T, s Store, q *Query) ([]string, error) {
+	t.Helper()
+	var names []string
+	it := s.Run(context.Background(), q)
+	for {
+		var e memoryTestEntity
+		_, err := it.Next(&e)
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, e.Name)
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	s, keys := newMemoryTestStore(t)
+	acme := datastore.IDKey("memparent", 1, nil)
+
+	tests := []struct {
+		name  string
+		query *Query
+		want  []string
+		err   bool
+	}{
+		{"kind", NewQuery("memchild"), []string{"a", "b", "c", "d"}, false},
+		{"other kind", NewQuery("memparent"), nil, false},
+		{"ancestor", NewQuery("memchild").Ancestor(acme), []string{"a", "b", "c"}, false},
+		{"ancestor itself", NewQuery("").Ancestor(acme), []string{"a", "b", "c"}, false},
+		{"key", NewQuery("memchild").Filter("__key__ =", keys[3]), []string{"d"}, false},
+		{"equal", NewQuery("memchild").Filter("Name =", "b"), []string{"b"}, false},
+		{"not equal", NewQuery("memchild").Filter("Name !=", "b"), []string{"a", "c", "d"}, false},
+		{"less", NewQuery("memchild").Filter("Rank <", 2), []string{"b"}, false},
+		{"less or equal", NewQuery("memchild").Filter("Rank <=", 2), []string{"b", "c"}, false},
+		{"greater", NewQuery("memchild").Filter("Rank >", 2), []string{"a", "d"}, false},
+		{"greater or equal float", NewQuery("memchild").Filter("Rank >=", 3.0), []string{"a", "d"}, false},
+		{"in", NewQuery("memchild").Filter("Name in", []string{"a", "d", "x"}), []string{"a", "d"}, false},
+		{"not in", NewQuery("memchild").Filter("Name not-in", []string{"a", "d"}), []string{"b", "c"}, false},
+		{"multi valued", NewQuery("memchild").Filter("Tags =", "red"), []string{"a", "d"}, false},
+		{"missing property", NewQuery("memchild").Filter("Missing !=", "x"), nil, false},
+		{"order", NewQuery("memchild").Order("Rank"), []string{"b", "c", "a", "d"}, false},
+		{"order desc", NewQuery("memchild").Order("-Rank"), []string{"d", "a", "c", "b"}, false},
+		{"order and limit", NewQuery("memchild").Ancestor(acme).Order("-Name").Limit(2), []string{"c", "b"}, false},
+		{"bad operator", NewQuery("memchild").Filter("Name ~", "a"), nil, true},
+		{"empty in", NewQuery("memchild").Filter("Name in", []string{}), nil, true},
+		{"bad cursor", NewQuery("memchild").Start("x"), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := memoryTestNames(t, s, tt.query)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+
+			count, err := s.Count(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(tt.want) {
+				t.Fatalf("counted %d, want %d", count, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMemoryStoreCursor(t *testing.T) {
+	s, _ := newMemoryTestStore(t)
+	q := NewQuery("memchild").Order("Name").Limit(3)
+
+	var names []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		it := s.Run(context.Background(), q.Start(cursor))
+		n := 0
+		for {
+			var e memoryTestEntity
+			_, err := it.Next(&e)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, e.Name)
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		var err error
+		cursor, err = it.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(names) != 4 || names[0] != "a" || names[3] != "d" {
+		t.Fatalf("paged %v, want [a b c d]", names)
+	}
+}
+
+func TestMemoryStoreKeysOnlyAndProjection(t *testing.T) {
+	s, keys := newMemoryTestStore(t)
+
+	it := s.Run(context.Background(), NewQuery("memchild").Filter("Name =", "a").KeysOnly())
+	var e memoryTestEntity
+	k, err := it.Next(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.Equal(keys[0]) || e.Name != "" {
+		t.Fatalf("keys only returned %v %+v", k, e)
+	}
+
+	it = s.Run(context.Background(), NewQuery("memchild").Filter("Name =", "a").Project("Name"))
+	e = memoryTestEntity{}
+	_, err = it.Next(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "a" || e.Rank != 0 {
+		t.Fatalf("projection loaded %+v", e)
+	}
+}
+
+func TestMemoryStoreMulti(t *testing.T) {
+	s, keys := newMemoryTestStore(t)
+	ctx := context.Background()
+
+	missing := datastore.IDKey("memchild", 99, nil)
+	dst := make([]memoryTestEntity, 2)
+	err := s.GetMulti(ctx, []*datastore.Key{keys[1], missing}, dst)
+	var multi datastore.MultiError
+	if !errors.As(err, &multi) || multi[0] != nil || multi[1] != datastore.ErrNoSuchEntity {
+		t.Fatalf("got %v, want the missing entity in a MultiError", err)
+	}
+	if dst[0].Name != "b" {
+		t.Fatalf("loaded %+v", dst[0])
+	}
+
+	err = s.DeleteMulti(ctx, keys[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e memoryTestEntity
+	if err := s.Get(ctx, keys[0], &e); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("got %v after delete", err)
+	}
+
+	allocated, err := s.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("memchild", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if allocated[0].Equal(k) {
+			t.Fatalf("allocated the taken key %v", k)
+		}
+	}
+}
+
+func TestMemoryStoreTransaction(t *testing.T) {
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+
+	tests := []struct {
+		name string
+		// f runs in the transaction, with the store to write out of it
+		f       func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error
+		err     error
+		wantA   string
+		deleted bool
+	}{
+		{
+			name: "commit",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				_, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"})
+				return err
+			},
+			wantA: "changed",
+		},
+		{
+			name: "read own write",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				if _, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"}); err != nil {
+					return err
+				}
+				var e memoryTestEntity
+				if err := tx.Get(keys[0], &e); err != nil {
+					return err
+				}
+				if e.Name != "changed" {
+					return errors.New("transaction didn't read its write")
+				}
+				return nil
+			},
+			wantA: "changed",
+		},
+		{
+			name: "delete",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				return tx.Delete(keys[0])
+			},
+			deleted: true,
+		},
+		{
+			name: "rollback",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				if _, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"}); err != nil {
+					return err
+				}
+				return errRollback
+			},
+			err:   errRollback,
+			wantA: "a",
+		},
+		{
+			name: "contention",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				var e memoryTestEntity
+				if err := tx.Get(keys[0], &e); err != nil {
+					return err
+				}
+				if _, err := s.Put(ctx, keys[0], &memoryTestEntity{Name: "outside"}); err != nil {
+					return err
+				}
+				_, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"})
+				return err
+			},
+			err:   datastore.ErrConcurrentTransaction,
+			wantA: "outside",
+		},
+		{
+			name: "contention on missing entity",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				missing := datastore.IDKey("memchild", 99, nil)
+				var e memoryTestEntity
+				if err := tx.Get(missing, &e); err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				if _, err := s.Put(ctx, missing, &memoryTestEntity{Name: "outside"}); err != nil {
+					return err
+				}
+				_, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"})
+				return err
+			},
+			err:   datastore.ErrConcurrentTransaction,
+			wantA: "a",
+		},
+		{
+			name: "write to other entity",
+			f: func(s *MemoryStore, tx Transaction, keys []*datastore.Key) error {
+				var e memoryTestEntity
+				if err := tx.Get(keys[0], &e); err != nil {
+					return err
+				}
+				if _, err := s.Put(ctx, keys[1], &memoryTestEntity{Name: "outside"}); err != nil {
+					return err
+				}
+				_, err := tx.Put(keys[0], &memoryTestEntity{Name: "changed"})
+				return err
+			},
+			wantA: "changed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newMemoryTestStore(t)
+			err := s.Transaction(ctx, func(tx Transaction) error {
+				return tt.f(s, tx, keys)
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			var e memoryTestEntity
+			err = s.Get(ctx, keys[0], &e)
+			if tt.deleted {
+				if err != datastore.ErrNoSuchEntity {
+					t.Fatalf("got %v, want the entity deleted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Name != tt.wantA {
+				t.Fatalf("stored %q, want %q", e.Name, tt.wantA)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRunInTransactionRetry(t *testing.T) {
+	s, keys := newMemoryTestStore(t)
+	app, err := New(Config{Store: s, Registry: NewRegistry(), DisableFirebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	ctx := context.Background()
+
+	// the first run is disturbed by a write out of the transaction, the second commits
+	runs := 0
+	err = app.RunInTransaction(ctx, func(tx Transaction) error {
+		runs++
+		var e memoryTestEntity
+		if err := tx.Get(keys[0], &e); err != nil {
+			return err
+		}
+		if runs == 1 {
+			if _, err := s.Put(ctx, keys[0], &memoryTestEntity{Name: "outside", Rank: 10}); err != nil {
+				return err
+			}
+		}
+		e.Rank++
+		_, err := tx.Put(keys[0], &e)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Fatalf("ran %d times, want 2", runs)
+	}
+	var e memoryTestEntity
+	if err := s.Get(ctx, keys[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "outside" || e.Rank != 11 {
+		t.Fatalf("stored %+v, want the second run on top of the outside write", e)
+	}
+
+	// contention on every run gives up after the configured attempts
+	runs = 0
+	err = app.RunInTransaction(ctx, func(tx Transaction) error {
+		runs++
+		var e memoryTestEntity
+		if err := tx.Get(keys[0], &e); err != nil {
+			return err
+		}
+		_, err := s.Put(ctx, keys[0], &e)
+		return err
+	})
+	if !errors.Is(err, datastore.ErrConcurrentTransaction) || runs != DefaultTransactionAttempts {
+		t.Fatalf("got %v after %d runs, want contention after %d", err, runs, DefaultTransactionAttempts)
+	}
+}
@@ -0,0 +1,153 @@
+package aeio
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultTransactionAttempts is how many times a transaction runs when it keeps failing by contention.
+const DefaultTransactionAttempts = 3
+
+// RunInTransaction runs f in a transaction of the default App store. See App.RunInTransaction.
+func RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return Default().RunInTransaction(ctx, f)
+}
+
+// RunInTransaction runs f in a store transaction, running it again with a growing pause when the commit fails by
+// contention (datastore.ErrConcurrentTransaction), up to Config.TransactionAttempts times. As f may run more than
+// once, it must not keep state between runs. Resources join the transaction with UseTransaction:
+//
+//	err := app.RunInTransaction(ctx, func(tx aeio.Transaction) error {
+//		from.UseTransaction(tx)
+//		to.UseTransaction(tx)
+//		... update both ...
+//	})
+func (app *App) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = app.Store.Transaction(ctx, f)
+		if !errors.Is(err, datastore.ErrConcurrentTransaction) || attempt >= app.Config.TransactionAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt*attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+// UseTransaction makes the actions of the resource, and so its hooks, read and write through the transaction.
+// Hooks reach it with Transaction to load and save other entities atomically with the resource.
+// Pass nil to leave the transaction, which is needed to use the resource after it ends.
+func (r *Resource) UseTransaction(tx Transaction) {
+	r.tx = tx
+}
+
+// Transaction returns the transaction the resource is in, or nil. Resources join the transaction their Access is
+// running in, so the actions hooks run on other resources of the request are part of it too.
+func (r *Resource) Transaction() Transaction {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.Access.transaction()
+}
+
+// RunInTransaction runs f with the resource in a new transaction of its App, retrying on contention. If the
+// resource is already in a transaction, f just joins it. Either way, the other resources of the Access join it while
+// f runs, so a hook error rolls everything back, but hooks may run more than once.
+func (r *Resource) RunInTransaction(f func(tx Transaction) error) error {
+	if tx := r.Transaction(); tx != nil {
+		defer r.Access.enterTransaction(tx)()
+		return f(tx)
+	}
+	defer r.UseTransaction(nil)
+	return r.App().RunInTransaction(r.Context(), func(tx Transaction) error {
+		r.UseTransaction(tx)
+		defer r.Access.enterTransaction(tx)()
+		return f(tx)
+	})
+}
+
+// writeInTransaction runs the write f of an action in a transaction if it must be atomic, if the kind was registered
+// with RegisterTransactional, or if the resource is already in one. Otherwise f runs directly against the store.
+func (r *Resource) writeInTransaction(atomic bool, f func() error) error {
+	if atomic || r.Transaction() != nil || r.App().Registry.Transactional(r.Key.Kind) {
+		return r.RunInTransaction(func(tx Transaction) error {
+			return f()
+		})
+	}
+	return f()
+}
+
+// storeGet, storePut and storeDelete go through the resource transaction if there is one, or directly to the store.
+func (r *Resource) storeGet(key *datastore.Key, dst interface{}) error {
+	if tx := r.Transaction(); tx != nil {
+		return tx.Get(key, dst)
+	}
+	return r.App().Store.Get(r.Context(), key, dst)
+}
+
+func (r *Resource) storePut(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if tx := r.Transaction(); tx != nil {
+		return tx.Put(key, src)
+	}
+	return r.App().Store.Put(r.Context(), key, src)
+}
+
+func (r *Resource) storeDelete(key *datastore.Key) error {
+	if tx := r.Transaction(); tx != nil {
+		return tx.Delete(key)
+	}
+	return r.App().Store.Delete(r.Context(), key)
+}
+
+// storeGetMulti, storePutMulti and storeDeleteMulti are the multi versions. Writes in transactions go one by one.
+func (r *Resource) storeGetMulti(keys []*datastore.Key, dst interface{}) error {
+	if tx := r.Transaction(); tx != nil {
+		return tx.GetMulti(keys, dst)
+	}
+	return r.App().Store.GetMulti(r.Context(), keys, dst)
+}
+
+func (r *Resource) storePutMulti(keys []*datastore.Key, src []*Resource) ([]*datastore.Key, error) {
+	tx := r.Transaction()
+	if tx == nil {
+		return r.App().Store.PutMulti(r.Context(), keys, src)
+	}
+	complete := make([]*datastore.Key, len(keys))
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		complete[i], errs[i] = tx.Put(key, src[i])
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return complete, errs
+	}
+	return complete, nil
+}
+
+func (r *Resource) storeDeleteMulti(keys []*datastore.Key) error {
+	tx := r.Transaction()
+	if tx == nil {
+		return r.App().Store.DeleteMulti(r.Context(), keys)
+	}
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = tx.Delete(key)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}